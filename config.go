@@ -2,10 +2,12 @@ package beego
 
 import (
 	"github.com/smithfox/beego/config"
+	"github.com/smithfox/beego/context"
 	"html/template"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 var (
@@ -17,8 +19,8 @@ var (
 	HttpPort          int
 	HttpsPort         int
 	HttpsListen       bool
-	HttpsExposeURL    bool
-	HttpsRedirectOnly bool
+	HttpsExposeURL    bool //https and http are exposed on the default ports 443 and 80
+	HttpsRedirectOnly bool //the http listener only redirects to https
 	HttpsCertFile     string
 	HttpsKeyFile      string
 	RecoverPanic      bool
@@ -45,6 +47,14 @@ var (
 	TemplateLeft      string
 	TemplateRight     string
 	ProxyBackend      bool //被代理模式
+
+	TrustedProxies        []string //CIDRs of the proxies trusted in ProxyBackend mode
+	MemZipCacheSize       int64    //byte budget of the OpenMemZipFile cache, 0 disables it
+	MemZipMaxFileSize     int64    //larger files are not cached, 0 for all files
+	HttpsRedirectStatus   int      //status of the redirects between http and https
+	HstsMaxAge            int      //Strict-Transport-Security max-age in seconds, 0 disables it
+	HstsIncludeSubDomains bool
+	HstsPreload           bool
 )
 
 func init() {
@@ -74,6 +84,9 @@ func init() {
 	TemplateLeft = "{{"
 	TemplateRight = "}}"
 	ProxyBackend = false
+	MemZipCacheSize = 1 << 25   //32MB
+	MemZipMaxFileSize = 1 << 22 //4MB
+	HttpsRedirectStatus = 308
 	//ParseConfig()
 	//runtime.GOMAXPROCS(runtime.NumCPU())
 }
@@ -108,6 +121,18 @@ func ParseConfig() (err error) {
 		if redirectonly, err := AppConfig.Bool("https.redirect_only"); err == nil {
 			HttpsRedirectOnly = redirectonly
 		}
+		if status, err := AppConfig.Int("https.redirect_status"); err == nil {
+			HttpsRedirectStatus = status
+		}
+		if maxage, err := AppConfig.Int("https.hsts_maxage"); err == nil {
+			HstsMaxAge = maxage
+		}
+		if subdomains, err := AppConfig.Bool("https.hsts_subdomains"); err == nil {
+			HstsIncludeSubDomains = subdomains
+		}
+		if preload, err := AppConfig.Bool("https.hsts_preload"); err == nil {
+			HstsPreload = preload
+		}
 		if sessionon, err := AppConfig.Bool("session"); err == nil {
 			SessionOn = sessionon
 		}
@@ -175,6 +200,24 @@ func ParseConfig() (err error) {
 		if proxy_backend, err := AppConfig.Bool("proxy_backend"); err == nil {
 			ProxyBackend = proxy_backend
 		}
+		if trusted := AppConfig.String("proxy_trusted"); trusted != "" {
+			TrustedProxies = strings.Split(trusted, ",")
+		}
+		if ProxyBackend {
+			//默认只信任本机的代理
+			if len(TrustedProxies) == 0 {
+				TrustedProxies = []string{"127.0.0.1", "::1"}
+			}
+			if err := context.SetTrustedProxies(TrustedProxies...); err != nil {
+				return err
+			}
+		}
+		if cachesize, err := AppConfig.Int64("memzip.cachesize"); err == nil {
+			MemZipCacheSize = cachesize
+		}
+		if maxfilesize, err := AppConfig.Int64("memzip.maxfilesize"); err == nil {
+			MemZipMaxFileSize = maxfilesize
+		}
 	}
 	return nil
 }
@@ -1,9 +1,11 @@
 package context
 
 import (
+	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -140,41 +142,34 @@ func (ctx *Context) IsUpload() bool {
 	return ctx.R.MultipartForm != nil
 }
 
+// Proxy returns the IPs of the client then of the proxies the request went
+// through, from the forwarding headers of the trusted proxies only, see
+// SetTrustedProxies.
 func (ctx *Context) Proxy() []string {
-	var ips string = ""
-	ips = ctx.GetHeader("X-Real-IP")
-	if len(ips) < 7 {
-		ips = ctx.GetHeader("X-Forwarded-For")
-		if len(ips) < 7 {
-			ips = ctx.GetHeader("HTTP_X_FORWARDED_FOR")
-			if len(ips) < 7 {
-				ips = ctx.GetHeader("Proxy-Client-IP")
-				if len(ips) < 7 {
-					ips = ctx.GetHeader("WL-Proxy-Client-IP")
-				}
-			}
-		}
-	}
-	if ips != "" {
-		return strings.Split(ips, ",")
+	if chain := ProxyChain(ctx.R); chain != nil {
+		return chain
 	}
 	return []string{}
 }
 
+// IP returns the IP of the client, see ClientIP.
 func (ctx *Context) IP() string {
-	ips := ctx.Proxy()
-	if len(ips) > 0 && ips[0] != "" {
-		return ips[0]
-	}
-	ips = strings.Split(ctx.R.RemoteAddr, ":")
-	if len(ips) == 2 {
-		return ips[0]
-	} else if len(ips) == 1 {
-		return ips[0]
+	if ip := ClientIP(ctx.R); ip != "" {
+		return ip
 	}
 	return "127.0.0.1"
 }
 
+// Scheme returns "https" or "http", as seen by the client.
+func (ctx *Context) Scheme() string {
+	return RequestScheme(ctx.R)
+}
+
+// Host returns the host asked by the client, with its port if any.
+func (ctx *Context) Host() string {
+	return RequestHost(ctx.R)
+}
+
 func (ctx *Context) GetURLRouterParam(key string) string {
 	if v, ok := ctx.Param[key]; ok {
 		return v
@@ -182,6 +177,46 @@ func (ctx *Context) GetURLRouterParam(key string) string {
 	return ""
 }
 
+// ParamInt returns the route param as an int, see {id:int} routes.
+func (ctx *Context) ParamInt(key string) (int, error) {
+	v, err := ctx.param(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+// ParamInt64 returns the route param as an int64.
+func (ctx *Context) ParamInt64(key string) (int64, error) {
+	v, err := ctx.param(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// ParamUUID returns the route param as a lower case UUID string, see
+// {id:uuid} routes.
+func (ctx *Context) ParamUUID(key string) (string, error) {
+	v, err := ctx.param(key)
+	if err != nil {
+		return "", err
+	}
+	if !uuidRegexp.MatchString(v) {
+		return "", fmt.Errorf("context: route param %q is not a UUID: %q", key, v)
+	}
+	return strings.ToLower(v), nil
+}
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func (ctx *Context) param(key string) (string, error) {
+	if v, ok := ctx.Param[key]; ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("context: route param %q not found", key)
+}
+
 func (ctx *Context) DecodeForm(dst interface{}) error {
 	return gGorillaDecoder.Decode(dst, ctx.GetForm())
 }
@@ -0,0 +1,258 @@
+package context
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedLock    sync.RWMutex
+	trustedProxies []*net.IPNet
+)
+
+// SetTrustedProxies sets the proxies, as CIDRs or single IPs, whose
+// forwarding headers are honoured: Forwarded (RFC 7239), X-Forwarded-For,
+// X-Real-IP, X-Forwarded-Proto and X-Forwarded-Host. The headers of the other peers are
+// ignored, so they can't spoof the scheme, host or client IP.
+// No proxy is trusted by default.
+func SetTrustedProxies(cidrs ...string) error {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("context: invalid trusted proxy %q: %v", cidr, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	trustedLock.Lock()
+	trustedProxies = nets
+	trustedLock.Unlock()
+	return nil
+}
+
+// IsTrustedProxy returns true if addr, an IP with an optional port, is a
+// trusted proxy.
+func IsTrustedProxy(addr string) bool {
+	trustedLock.RLock()
+	defer trustedLock.RUnlock()
+	if len(trustedProxies) == 0 {
+		return false
+	}
+	ip := net.ParseIP(stripPort(addr))
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range trustedProxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwarding is what the trusted proxies tell about a request.
+type forwarding struct {
+	// Addresses of the client then of the trusted proxies, the peer is not
+	// included. Empty if the peer is not trusted.
+	chain []string
+	proto string
+	host  string
+}
+
+// forwarded returns what the trusted proxies of the request tell.
+//
+// The addresses are read from the right, the peer first: the first address
+// which is not a trusted proxy is the client, the addresses on its left may
+// have been forged. The scheme and host are the ones seen by the proxy next
+// to the client if the proxies give one per hop, else by the peer.
+func forwarded(req *http.Request) forwarding {
+	var fw forwarding
+	if !IsTrustedProxy(req.RemoteAddr) {
+		return fw
+	}
+	var fors, protos, hosts []string
+	if h := req.Header["Forwarded"]; len(h) > 0 {
+		for _, elem := range splitForwarded(h) {
+			params := parseForwardedElement(elem)
+			fors = append(fors, params["for"])
+			protos = append(protos, params["proto"])
+			hosts = append(hosts, params["host"])
+		}
+	} else {
+		fors = splitHeader(req.Header["X-Forwarded-For"])
+		if len(fors) == 0 {
+			// The client seen by the peer, set by nginx.
+			if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); ip != "" {
+				fors = []string{ip}
+			}
+		}
+		protos = splitHeader(req.Header["X-Forwarded-Proto"])
+		if len(protos) == 0 {
+			// Ad-hoc header honoured before X-Forwarded-Proto.
+			protos = splitHeader(req.Header["X-Scheme"])
+		}
+		hosts = splitHeader(req.Header["X-Forwarded-Host"])
+	}
+	client := 0
+	for i := len(fors) - 1; i >= 0; i-- {
+		if !IsTrustedProxy(fors[i]) {
+			client = i
+			break
+		}
+	}
+	if len(fors) > 0 {
+		fw.chain = make([]string, 0, len(fors)-client)
+		for _, addr := range fors[client:] {
+			fw.chain = append(fw.chain, stripPort(addr))
+		}
+	}
+	fw.proto = strings.ToLower(hopValue(protos, len(fors), client))
+	fw.host = hopValue(hosts, len(fors), client)
+	return fw
+}
+
+// hopValue returns the value of the client hop if there is one value per
+// address, else the last one, given by the peer.
+func hopValue(values []string, n, client int) string {
+	if len(values) == n && n > 0 && values[client] != "" {
+		return values[client]
+	}
+	if len(values) > 0 {
+		return values[len(values)-1]
+	}
+	return ""
+}
+
+// splitHeader splits the comma separated values of a header.
+func splitHeader(lines []string) []string {
+	var values []string
+	for _, line := range lines {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// splitForwarded splits the Forwarded header in elements, on the commas
+// which are not in a quoted string.
+func splitForwarded(lines []string) []string {
+	var elems []string
+	for _, line := range lines {
+		for _, elem := range splitQuoted(line, ',') {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				elems = append(elems, elem)
+			}
+		}
+	}
+	return elems
+}
+
+// parseForwardedElement parses `for=192.0.2.60;proto=https;by=...`. The
+// values can be quoted strings, see RFC 7230 section 3.2.6.
+func parseForwardedElement(elem string) map[string]string {
+	params := map[string]string{}
+	for _, pair := range splitQuoted(elem, ';') {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = unquote(kv[1])
+	}
+	return params
+}
+
+// splitQuoted splits s on sep, except in the quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote returns the content of a quoted string, or s if it is not quoted.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	s = s[1 : len(s)-1]
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+// stripPort removes the port of "ip:port", "[ipv6]:port" or "[ipv6]".
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// RequestScheme returns "https" or "http", as seen by the client.
+func RequestScheme(req *http.Request) string {
+	if fw := forwarded(req); fw.proto == "https" || fw.proto == "http" {
+		return fw.proto
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RequestHost returns the host, with its port if any, asked by the client.
+func RequestHost(req *http.Request) string {
+	if fw := forwarded(req); fw.host != "" {
+		return fw.host
+	}
+	return req.Host
+}
+
+// ClientIP returns the IP of the client, told by the trusted proxies.
+func ClientIP(req *http.Request) string {
+	if fw := forwarded(req); len(fw.chain) > 0 {
+		return fw.chain[0]
+	}
+	return stripPort(req.RemoteAddr)
+}
+
+// ProxyChain returns the IPs of the client then of the trusted proxies it
+// went through, without the peer. It is empty if the peer is not a trusted
+// proxy.
+func ProxyChain(req *http.Request) []string {
+	return forwarded(req).chain
+}
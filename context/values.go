@@ -0,0 +1,107 @@
+package context
+
+import (
+	stdcontext "context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type valuesKey struct{}
+
+// valueStore is a context of the request holding the request-scoped values.
+// It is shared by the copies of the request made with WithContext, so the
+// values set by a filter reach the handler.
+type valueStore struct {
+	stdcontext.Context
+	lock   sync.RWMutex
+	values map[interface{}]interface{}
+}
+
+func (s *valueStore) Value(key interface{}) interface{} {
+	if key == (valuesKey{}) {
+		return s
+	}
+	s.lock.RLock()
+	v, ok := s.values[key]
+	s.lock.RUnlock()
+	if ok {
+		return v
+	}
+	return s.Context.Value(key)
+}
+
+func (s *valueStore) set(key, value interface{}) {
+	s.lock.Lock()
+	if s.values == nil {
+		s.values = make(map[interface{}]interface{})
+	}
+	s.values[key] = value
+	s.lock.Unlock()
+}
+
+func loadStore(req *http.Request) *valueStore {
+	s, _ := req.Context().Value(valuesKey{}).(*valueStore)
+	return s
+}
+
+// WithValues returns the request with a store of request-scoped values, see
+// SetValue. The request is returned if it has one already: the requests
+// served by route.Router do.
+func WithValues(req *http.Request) *http.Request {
+	if loadStore(req) != nil {
+		return req
+	}
+	return req.WithContext(&valueStore{Context: req.Context()})
+}
+
+// SetValue stores a request-scoped value, returned by Context.Get and by the
+// Value method of the request context, e.g. from a filter:
+//
+//     func auth(w http.ResponseWriter, req *http.Request) bool {
+//         context.SetValue(req, userKey{}, user)
+//         return true
+//     }
+//
+// The value is stored in place if the request has a store, see WithValues,
+// else in a copy of the request with one, which is returned.
+func SetValue(req *http.Request, key, value interface{}) *http.Request {
+	req = WithValues(req)
+	loadStore(req).set(key, value)
+	return req
+}
+
+// Set stores a request-scoped value, see SetValue. Keys are compared as
+// the keys of context.WithValue: use a type of your package to avoid
+// collisions.
+func (ctx *Context) Set(key, value interface{}) {
+	ctx.R = SetValue(ctx.R, key, value)
+}
+
+// Get returns the request-scoped value of the key: the one stored by Set or
+// SetValue, else the one of the request context. It returns nil if there is
+// none.
+func (ctx *Context) Get(key interface{}) interface{} {
+	return ctx.R.Context().Value(key)
+}
+
+// Deadline returns the deadline of the request context. With Done, Err and
+// Value, the Context is a context.Context for the libraries taking one.
+func (ctx *Context) Deadline() (time.Time, bool) {
+	return ctx.R.Context().Deadline()
+}
+
+// Done is closed when the client goes away or the request is canceled.
+func (ctx *Context) Done() <-chan struct{} {
+	return ctx.R.Context().Done()
+}
+
+// Err returns why Done is closed.
+func (ctx *Context) Err() error {
+	return ctx.R.Context().Err()
+}
+
+// Value is Get, for context.Context.
+func (ctx *Context) Value(key interface{}) interface{} {
+	return ctx.Get(key)
+}
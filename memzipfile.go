@@ -63,6 +63,7 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"container/list"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -73,82 +74,227 @@ import (
 	"time"
 )
 
-var gmfim map[string]*MemFileInfo = make(map[string]*MemFileInfo)
-var gmzflock sync.RWMutex
+var errMemZipLoadPanic = errors.New("OpenMemZipFile: the load of the file panicked")
 
-//TODO: 加锁保证数据完整性
+var gmzcache = &memZipCache{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+	loading: make(map[string]*memZipLoad),
+}
+
+// OpenMemZipFile opens the file at path, its content compressed with zip
+// ("gzip", "deflate" or "" for none) and cached in memory.
+//
+// The cache holds at most MemZipCacheSize bytes, the least recently used
+// files are evicted first. Files larger than MemZipMaxFileSize are not
+// cached: they are read from disk if zip is "", else compressed again on each
+// open. For both sizes, 0 disables: nothing is cached, or no file is.
+// Concurrent opens of the same cached file wait for a single read and
+// compression.
 func OpenMemZipFile(path string, zip string) (*MemFile, error) {
 	osfile, e := os.Open(path)
 	if e != nil {
 		return nil, e
 	}
-	defer osfile.Close()
 
 	osfileinfo, e := osfile.Stat()
 	if e != nil {
+		osfile.Close()
 		return nil, e
 	}
 
-	modtime := osfileinfo.ModTime()
 	fileSize := osfileinfo.Size()
+	if (MemZipMaxFileSize <= 0 || fileSize > MemZipMaxFileSize) && !osfileinfo.IsDir() {
+		//大文件不缓存: 不压缩时直接从磁盘读, 否则每次 open 都压缩
+		if zip == "" {
+			fi := &MemFileInfo{FileInfo: osfileinfo, modTime: osfileinfo.ModTime(), contentSize: fileSize, fileSize: fileSize}
+			return &MemFile{fi: fi, osfile: osfile}, nil
+		}
+		defer osfile.Close()
+		fi, e := readMemZipFile(osfile, osfileinfo, zip)
+		if e != nil {
+			return nil, e
+		}
+		return &MemFile{fi: fi, offset: 0}, nil
+	}
+	defer osfile.Close()
 
-	gmzflock.RLock()
-	cfi, ok := gmfim[zip+":"+path]
-	gmzflock.RUnlock()
+	cfi, e := gmzcache.get(zip+":"+path, osfileinfo, func() (*MemFileInfo, error) {
+		return readMemZipFile(osfile, osfileinfo, zip)
+	})
+	if e != nil {
+		return nil, e
+	}
+	return &MemFile{fi: cfi, offset: 0}, nil
+}
 
-	if ok && cfi.ModTime() == modtime && cfi.fileSize == fileSize {
-		//fmt.Printf("read %s file %s from cache\n", zip, path)
+// readMemZipFile reads the whole file, compressed with zip.
+func readMemZipFile(osfile *os.File, osfileinfo os.FileInfo, zip string) (*MemFileInfo, error) {
+	var content []byte
+	var e error
+	if zip == "gzip" {
+		//将文件内容压缩到zipbuf中
+		var zipbuf bytes.Buffer
+		gzipwriter, e := gzip.NewWriterLevel(&zipbuf, gzip.BestCompression)
+		if e != nil {
+			return nil, e
+		}
+		_, e = io.Copy(gzipwriter, osfile)
+		gzipwriter.Close()
+		if e != nil {
+			return nil, e
+		}
+		//读zipbuf到content
+		content, e = ioutil.ReadAll(&zipbuf)
+		if e != nil {
+			return nil, e
+		}
+	} else if zip == "deflate" {
+		//将文件内容压缩到zipbuf中
+		var zipbuf bytes.Buffer
+		deflatewriter, e := flate.NewWriter(&zipbuf, flate.BestCompression)
+		if e != nil {
+			return nil, e
+		}
+		_, e = io.Copy(deflatewriter, osfile)
+		deflatewriter.Close()
+		if e != nil {
+			return nil, e
+		}
+		//将zipbuf读入到content
+		content, e = ioutil.ReadAll(&zipbuf)
+		if e != nil {
+			return nil, e
+		}
 	} else {
-		//fmt.Printf("NOT read %s file %s from cache\n", zip, path)
-		var content []byte
-		if zip == "gzip" {
-			//将文件内容压缩到zipbuf中
-			var zipbuf bytes.Buffer
-			gzipwriter, e := gzip.NewWriterLevel(&zipbuf, gzip.BestCompression)
-			if e != nil {
-				return nil, e
-			}
-			_, e = io.Copy(gzipwriter, osfile)
-			gzipwriter.Close()
-			if e != nil {
-				return nil, e
-			}
-			//读zipbuf到content
-			content, e = ioutil.ReadAll(&zipbuf)
-			if e != nil {
-				return nil, e
-			}
-		} else if zip == "deflate" {
-			//将文件内容压缩到zipbuf中
-			var zipbuf bytes.Buffer
-			deflatewriter, e := flate.NewWriter(&zipbuf, flate.BestCompression)
-			if e != nil {
-				return nil, e
-			}
-			_, e = io.Copy(deflatewriter, osfile)
-			deflatewriter.Close()
-			if e != nil {
-				return nil, e
-			}
-			//将zipbuf读入到content
-			content, e = ioutil.ReadAll(&zipbuf)
-			if e != nil {
-				return nil, e
-			}
-		} else {
-			content, e = ioutil.ReadAll(osfile)
-			if e != nil {
-				return nil, e
-			}
+		content, e = ioutil.ReadAll(osfile)
+		if e != nil {
+			return nil, e
+		}
+	}
+	return &MemFileInfo{
+		FileInfo:    osfileinfo,
+		modTime:     osfileinfo.ModTime(),
+		content:     content,
+		contentSize: int64(len(content)),
+		fileSize:    osfileinfo.Size(),
+		zip:         zip,
+	}, nil
+}
+
+// MemZipStats are the counters of the OpenMemZipFile cache.
+type MemZipStats struct {
+	Hits      int64 // opens served from the cache
+	Misses    int64 // opens which read the file
+	Evictions int64 // files evicted to stay within MemZipCacheSize
+	Files     int   // files in the cache
+	Bytes     int64 // size of the cached contents
+}
+
+// MemZipCacheStats returns the counters of the OpenMemZipFile cache.
+func MemZipCacheStats() MemZipStats {
+	c := gmzcache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return MemZipStats{Hits: c.hits, Misses: c.misses, Evictions: c.evictions, Files: len(c.entries), Bytes: c.size}
+}
+
+// ClearMemZipCache removes all the files of the OpenMemZipFile cache and
+// resets its counters.
+func ClearMemZipCache() {
+	c := gmzcache
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.size, c.hits, c.misses, c.evictions = 0, 0, 0, 0
+}
+
+// memZipCache is a LRU cache of file contents, by encoding and path.
+type memZipCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List //最近使用的在前
+	size    int64
+	//正在读的文件, 同一文件只读一次
+	loading map[string]*memZipLoad
+
+	hits, misses, evictions int64
+}
+
+type memZipEntry struct {
+	key string
+	fi  *MemFileInfo
+}
+
+type memZipLoad struct {
+	done chan struct{}
+	fi   *MemFileInfo
+	err  error
+}
+
+// get returns the cached content for key if it is still up to date with
+// osfileinfo, or reads it with load. Concurrent gets of the same key share
+// a single load.
+func (c *memZipCache) get(key string, osfileinfo os.FileInfo, load func() (*MemFileInfo, error)) (*MemFileInfo, error) {
+	c.lock.Lock()
+	if el, ok := c.entries[key]; ok {
+		fi := el.Value.(*memZipEntry).fi
+		if fi.modTime.Equal(osfileinfo.ModTime()) && fi.fileSize == osfileinfo.Size() {
+			c.lru.MoveToFront(el)
+			c.hits++
+			c.lock.Unlock()
+			return fi, nil
+		}
+		c.remove(el)
+	}
+	c.misses++
+	if l, ok := c.loading[key]; ok {
+		c.lock.Unlock()
+		<-l.done
+		return l.fi, l.err
+	}
+	l := &memZipLoad{done: make(chan struct{})}
+	c.loading[key] = l
+	c.lock.Unlock()
+
+	//load panic 时也要释放等待者, 否则之后同一文件的 open 永远阻塞
+	l.err = errMemZipLoadPanic
+	defer func() {
+		c.lock.Lock()
+		delete(c.loading, key)
+		if l.err == nil {
+			c.add(key, l.fi)
 		}
+		c.lock.Unlock()
+		close(l.done)
+	}()
+	l.fi, l.err = load()
+	return l.fi, l.err
+}
 
-		cfi = &MemFileInfo{osfileinfo, modtime, content, int64(len(content)), fileSize}
-		gmzflock.Lock()
-		gmfim[zip+":"+path] = cfi
-		gmzflock.Unlock()
-		//fmt.Printf("%s file %s to %d, cache it\n", zip, path, len(content))
+// add caches fi and evicts the least recently used files beyond the budget.
+// A content larger than the whole budget is not cached, nothing is if the
+// budget is 0.
+func (c *memZipCache) add(key string, fi *MemFileInfo) {
+	if MemZipCacheSize <= 0 || fi.contentSize > MemZipCacheSize {
+		return
 	}
-	return &MemFile{fi: cfi, offset: 0}, nil
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&memZipEntry{key, fi})
+	c.size += fi.contentSize
+	for c.size > MemZipCacheSize {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+func (c *memZipCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*memZipEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.fi.contentSize
 }
 
 type MemFileInfo struct {
@@ -157,10 +303,11 @@ type MemFileInfo struct {
 	content     []byte
 	contentSize int64
 	fileSize    int64
+	zip         string
 }
 
 func (fi *MemFileInfo) Name() string {
-	return fi.Name()
+	return fi.FileInfo.Name()
 }
 
 func (fi *MemFileInfo) Size() int64 {
@@ -168,7 +315,7 @@ func (fi *MemFileInfo) Size() int64 {
 }
 
 func (fi *MemFileInfo) Mode() os.FileMode {
-	return fi.Mode()
+	return fi.FileInfo.Mode()
 }
 
 func (fi *MemFileInfo) ModTime() time.Time {
@@ -176,22 +323,34 @@ func (fi *MemFileInfo) ModTime() time.Time {
 }
 
 func (fi *MemFileInfo) IsDir() bool {
-	return fi.IsDir()
+	return fi.FileInfo.IsDir()
 }
 
 func (fi *MemFileInfo) Sys() interface{} {
 	return nil
 }
 
+// MemFile is a file opened by OpenMemZipFile. Its content is in memory, or
+// read from osfile for the files too large to be cached.
 type MemFile struct {
 	fi     *MemFileInfo
 	offset int64
+	osfile *os.File
 }
 
 func (f *MemFile) Close() error {
+	if f.osfile != nil {
+		return f.osfile.Close()
+	}
 	return nil
 }
 
+// Zip returns the encoding of the content: "gzip", "deflate" or "" if it is
+// not compressed.
+func (f *MemFile) Zip() string {
+	return f.fi.zip
+}
+
 func (f *MemFile) Stat() (os.FileInfo, error) {
 	return f.fi, nil
 }
@@ -203,6 +362,9 @@ func (f *MemFile) Readdir(count int) ([]os.FileInfo, error) {
 }
 
 func (f *MemFile) Read(p []byte) (n int, err error) {
+	if f.osfile != nil {
+		return f.osfile.Read(p)
+	}
 	if len(f.fi.content)-int(f.offset) >= len(p) {
 		n = len(p)
 	} else {
@@ -218,6 +380,9 @@ var errWhence = errors.New("Seek: invalid whence")
 var errOffset = errors.New("Seek: invalid offset")
 
 func (f *MemFile) Seek(offset int64, whence int) (ret int64, err error) {
+	if f.osfile != nil {
+		return f.osfile.Seek(offset, whence)
+	}
 	switch whence {
 	default:
 		return 0, errWhence
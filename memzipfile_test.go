@@ -0,0 +1,188 @@
+package beego
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func writeMemZipTestFiles(t *testing.T, sizes map[string]int) string {
+	dir, err := ioutil.TempDir("", "memzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range sizes {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(strings.Repeat("a", size)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestMemZipCacheEviction(t *testing.T) {
+	defer func(size, max int64) { MemZipCacheSize, MemZipMaxFileSize = size, max }(MemZipCacheSize, MemZipMaxFileSize)
+	MemZipCacheSize, MemZipMaxFileSize = 250, 1000
+	ClearMemZipCache()
+	dir := writeMemZipTestFiles(t, map[string]int{"a": 100, "b": 100, "c": 100, "big": 2000})
+	defer os.RemoveAll(dir)
+
+	open := func(name, zip string) *MemFile {
+		f, err := OpenMemZipFile(filepath.Join(dir, name), zip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return f
+	}
+	open("a", "")
+	open("b", "")
+	open("a", "")
+	open("c", "")
+	stats := MemZipCacheStats()
+	if stats.Hits != 1 || stats.Misses != 3 || stats.Evictions != 1 || stats.Files != 2 || stats.Bytes != 200 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	// b was the least recently used.
+	open("a", "")
+	if stats = MemZipCacheStats(); stats.Hits != 2 {
+		t.Errorf("a must still be cached, %+v", stats)
+	}
+
+	f := open("big", "gzip")
+	if f.Zip() != "gzip" || f.fi.contentSize >= 2000 {
+		t.Errorf("big must be gzipped, got %q %d", f.Zip(), f.fi.contentSize)
+	}
+	f = open("big", "")
+	if f.Zip() != "" || f.fi.content != nil {
+		t.Error("large files must be read from disk")
+	}
+	if stats = MemZipCacheStats(); stats.Files != 2 {
+		t.Errorf("large files must not be cached, %+v", stats)
+	}
+	f, _ = OpenMemZipFile(filepath.Join(dir, "big"), "")
+	defer f.Close()
+	if content, _ := ioutil.ReadAll(f); len(content) != 2000 {
+		t.Errorf("read %d bytes of a large file", len(content))
+	}
+
+	f = open("c", "gzip")
+	if f.Zip() != "gzip" || f.fi.contentSize >= 100 {
+		t.Errorf("c must be gzipped, got %q %d", f.Zip(), f.fi.contentSize)
+	}
+}
+
+func TestMemZipCacheSingleLoad(t *testing.T) {
+	dir := writeMemZipTestFiles(t, map[string]int{"a": 10})
+	defer os.RemoveAll(dir)
+	osfileinfo, _ := os.Stat(filepath.Join(dir, "a"))
+
+	c := &memZipCache{entries: make(map[string]*list.Element), lru: list.New(), loading: make(map[string]*memZipLoad)}
+	var loads int32
+	release := make(chan struct{})
+	load := func() (*MemFileInfo, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return &MemFileInfo{FileInfo: osfileinfo, modTime: osfileinfo.ModTime(), fileSize: 10, contentSize: 10}, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.get("a", osfileinfo, load); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// Wait for all the gets to be blocked on the load.
+	for {
+		c.lock.Lock()
+		misses := c.misses
+		c.lock.Unlock()
+		if misses == 20 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+	if loads != 1 {
+		t.Errorf("file loaded %d times, want 1", loads)
+	}
+	c.get("a", osfileinfo, load)
+	if c.hits != 1 || len(c.entries) != 1 {
+		t.Errorf("unexpected cache state: %d hits, %d files", c.hits, len(c.entries))
+	}
+}
+
+func TestMemZipCacheDisabled(t *testing.T) {
+	defer func(size, max int64) { MemZipCacheSize, MemZipMaxFileSize = size, max }(MemZipCacheSize, MemZipMaxFileSize)
+	ClearMemZipCache()
+	dir := writeMemZipTestFiles(t, map[string]int{"a": 100})
+	defer os.RemoveAll(dir)
+
+	MemZipCacheSize, MemZipMaxFileSize = 0, 1000
+	f, err := OpenMemZipFile(filepath.Join(dir, "a"), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if f.Zip() != "gzip" {
+		t.Errorf("a must be gzipped, got %q", f.Zip())
+	}
+	if stats := MemZipCacheStats(); stats.Files != 0 {
+		t.Errorf("nothing must be cached, %+v", stats)
+	}
+
+	MemZipCacheSize, MemZipMaxFileSize = 1000, 0
+	f, err = OpenMemZipFile(filepath.Join(dir, "a"), "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if f.Zip() != "gzip" {
+		t.Errorf("a must still be gzipped, got %q", f.Zip())
+	}
+	if stats := MemZipCacheStats(); stats.Files != 0 {
+		t.Errorf("no file must be cached, %+v", stats)
+	}
+	f, err = OpenMemZipFile(filepath.Join(dir, "a"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if f.fi.content != nil {
+		t.Error("all the files must be read from disk")
+	}
+}
+
+func TestMemZipCacheLoadPanic(t *testing.T) {
+	dir := writeMemZipTestFiles(t, map[string]int{"a": 10})
+	defer os.RemoveAll(dir)
+	osfileinfo, _ := os.Stat(filepath.Join(dir, "a"))
+
+	c := &memZipCache{entries: make(map[string]*list.Element), lru: list.New(), loading: make(map[string]*memZipLoad)}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic of the load must go through")
+			}
+		}()
+		c.get("a", osfileinfo, func() (*MemFileInfo, error) { panic("boom") })
+	}()
+	if len(c.loading) != 0 {
+		t.Fatal("the load must be cleared after a panic")
+	}
+	fi, err := c.get("a", osfileinfo, func() (*MemFileInfo, error) {
+		return &MemFileInfo{FileInfo: osfileinfo, modTime: osfileinfo.ModTime(), fileSize: 10, contentSize: 10}, nil
+	})
+	if err != nil || fi == nil {
+		t.Errorf("a must load after a panic, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -297,12 +298,51 @@ func Exception(errcode string, w http.ResponseWriter, r *http.Request, msg strin
 		if err != nil {
 			isint = 500
 		}
-		if isint == 400 {
-			msg = "404 page not found"
-		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(isint)
 		fmt.Fprintln(w, msg)
 		return
 	}
 }
+
+// HTTPError is an error responded with its status, by the handler of
+// ErrorMaps for the status if any, see Exception.
+type HTTPError struct {
+	Status  int
+	Message string
+}
+
+// NewHTTPError returns an HTTPError. The message is the text of the status if
+// msg is "".
+func NewHTTPError(status int, msg string) error {
+	if msg == "" {
+		msg = http.StatusText(status)
+	}
+	return &HTTPError{Status: status, Message: msg}
+}
+
+func (e *HTTPError) Error() string {
+	return strconv.Itoa(e.Status) + " " + e.Message
+}
+
+// ErrorStatus returns the status of err: the one of the HTTPError it wraps,
+// else 500.
+func ErrorStatus(err error) int {
+	var he *HTTPError
+	if errors.As(err, &he) {
+		return he.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// ErrorException responds with the status of err, see ErrorStatus. The
+// message of the other errors than HTTPError is not shown to the client.
+func ErrorException(err error, w http.ResponseWriter, r *http.Request) {
+	status := ErrorStatus(err)
+	msg := http.StatusText(status)
+	var he *HTTPError
+	if errors.As(err, &he) && he.Message != "" {
+		msg = he.Message
+	}
+	Exception(strconv.Itoa(status), w, r, msg)
+}
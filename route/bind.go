@@ -0,0 +1,205 @@
+package route
+
+import (
+	"encoding"
+	"fmt"
+	"github.com/smithfox/beego/context"
+	"github.com/smithfox/beego/middleware"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// busTag holds the options of the bmgo tag of a field:
+//
+//     DB   *sql.DB `bmgo:"databus"`
+//     Read *sql.DB `bmgo:"databus,name=ReadDB,optional"`
+//     ID   int     `bmgo:"param=id"`
+//     Page int     `bmgo:"query=page,default=1"`
+//     Tags []string `bmgo:"form=tag"`
+//     Lang string  `bmgo:"header=Accept-Language"`
+//
+// A databus field is filled by the service or provider of its name, or of
+// the name option, else of its type. It is left empty if there is none and
+// the field is optional.
+//
+// The other fields are filled from the request: a route param, the query
+// string, the form values or a header, converted to the type of the field.
+// The default option is used if the request has no value. The values which
+// don't convert fail the request with a 400.
+type busTag struct {
+	databus bool
+	// Name of the service or provider of a databus field.
+	name     string
+	optional bool
+	// Where the value is read from the request: param, query, form or
+	// header, and its key.
+	source string
+	key    string
+	def    string
+	hasDef bool
+}
+
+// parseBusTag parses the bmgo tag of a field of type t. It returns nil if
+// the tag is empty.
+func parseBusTag(tag string, t reflect.Type) (*busTag, error) {
+	if tag == "" {
+		return nil, nil
+	}
+	bt := &busTag{}
+	for i, opt := range strings.Split(tag, ",") {
+		kv := strings.SplitN(opt, "=", 2)
+		k, v := strings.TrimSpace(kv[0]), ""
+		if len(kv) == 2 {
+			v = strings.TrimSpace(kv[1])
+		}
+		switch {
+		case i == 0 && k == "databus" && len(kv) == 1:
+			bt.databus = true
+		case i == 0 && (k == "param" || k == "query" || k == "form" || k == "header") && v != "":
+			bt.source, bt.key = k, v
+		case i > 0 && k == "name" && v != "" && bt.databus:
+			bt.name = v
+		case i > 0 && k == "optional" && len(kv) == 1 && bt.databus:
+			bt.optional = true
+		case i > 0 && k == "default" && len(kv) == 2 && bt.source != "":
+			bt.def, bt.hasDef = v, true
+		default:
+			return nil, fmt.Errorf("mux: invalid bmgo tag %q", tag)
+		}
+	}
+	if bt.source != "" {
+		if !bindable(t) {
+			return nil, fmt.Errorf("mux: can't convert %s values to %s", bt.source, t)
+		}
+		if bt.hasDef {
+			if err := setStrings(reflect.New(t).Elem(), []string{bt.def}); err != nil {
+				return nil, fmt.Errorf("mux: invalid default of bmgo tag %q: %v", tag, err)
+			}
+		}
+	}
+	return bt, nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// bindable returns true if setStrings converts to type t.
+func bindable(t reflect.Type) bool {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	case reflect.Ptr:
+		return bindable(t.Elem())
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Slice && bindable(t.Elem())
+	}
+	return false
+}
+
+// setStrings converts the request values to the field v: a slice takes all
+// of them, the other types the first one.
+func setStrings(v reflect.Value, values []string) error {
+	if v.Kind() == reflect.Slice && !v.Addr().Type().Implements(textUnmarshalerType) {
+		s := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setString(s.Index(i), value); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return setString(v, values[0])
+}
+
+func setString(v reflect.Value, s string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Ptr:
+		p := reflect.New(v.Type().Elem())
+		if err := setString(p.Elem(), s); err != nil {
+			return err
+		}
+		v.Set(p)
+	default:
+		return fmt.Errorf("can't convert to %s", v.Type())
+	}
+	return nil
+}
+
+// requestValues returns the values of the request for the source of tag.
+// query is parsed once per request.
+func requestValues(ctx *context.Context, tag *busTag, query *url.Values) []string {
+	switch tag.source {
+	case "param":
+		if v, ok := ctx.Param[tag.key]; ok {
+			return []string{v}
+		}
+	case "query":
+		if *query == nil {
+			*query = ctx.R.URL.Query()
+		}
+		return (*query)[tag.key]
+	case "form":
+		return ctx.GetForm()[tag.key]
+	case "header":
+		return ctx.R.Header[http.CanonicalHeaderKey(tag.key)]
+	}
+	return nil
+}
+
+// bind fills the fields of the bus bound to the request, see busTag.
+func (run *busRun) bind() error {
+	var query url.Values
+	for _, name := range run.bus.bt.bound {
+		f := run.bus.bt.fields[name]
+		values := requestValues(run.ctx, f.tag, &query)
+		if len(values) == 0 {
+			if !f.tag.hasDef {
+				continue
+			}
+			values = []string{f.tag.def}
+		}
+		if err := setStrings(run.bus.field(name), values); err != nil {
+			return middleware.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("invalid %s %q: %v", f.tag.source, f.tag.key, err))
+		}
+	}
+	return nil
+}
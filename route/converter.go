@@ -0,0 +1,98 @@
+package route
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Converter defines a typed route variable: {id:int} uses the converter
+// registered as "int" instead of a regexp.
+type Converter interface {
+	// Regexp returns the pattern matched by the variable.
+	Regexp() string
+	// ToURL formats a value given to URL building.
+	ToURL(v interface{}) (string, error)
+}
+
+// Guards converters, read when the routes are registered.
+var convertersLock sync.RWMutex
+
+var converters = map[string]Converter{
+	"int":  intConverter{},
+	"slug": &regexpConverter{pattern: `[a-zA-Z0-9_-]+`},
+	"uuid": &regexpConverter{pattern: `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`},
+	// Catch-all, the value spans slashes.
+	"path": &regexpConverter{pattern: `.*`},
+}
+
+// RegisterConverter registers a converter for {name:typ} variables.
+// It must be called before the routes using it are registered, it can be
+// called while other routers register or serve routes.
+func RegisterConverter(typ string, c Converter) {
+	convertersLock.Lock()
+	converters[typ] = c
+	convertersLock.Unlock()
+}
+
+// RegexpConverter returns a converter matching the pattern, formatting values
+// with fmt.Sprint.
+func RegexpConverter(pattern string) Converter {
+	return &regexpConverter{pattern: pattern}
+}
+
+type regexpConverter struct {
+	pattern string
+}
+
+func (c *regexpConverter) Regexp() string {
+	return c.pattern
+}
+
+func (c *regexpConverter) ToURL(v interface{}) (string, error) {
+	return fmt.Sprint(v), nil
+}
+
+// intConverter matches decimal integers and formats any integer type.
+type intConverter struct{}
+
+func (c intConverter) Regexp() string {
+	return `[0-9]+`
+}
+
+func (c intConverter) ToURL(v interface{}) (string, error) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10), nil
+	case reflect.String:
+		return rv.String(), nil
+	}
+	return "", fmt.Errorf("mux: can't format %T as int", v)
+}
+
+// varRegexp returns the regexp and the converter, if any, of a variable
+// pattern: a converter name or a regexp.
+func varRegexp(patt string) (string, Converter) {
+	convertersLock.RLock()
+	c, ok := converters[patt]
+	convertersLock.RUnlock()
+	if ok {
+		return c.Regexp(), c
+	}
+	return patt, nil
+}
+
+// formatVar formats the value of a variable for URL building.
+func formatVar(c Converter, v interface{}) (string, error) {
+	if c != nil {
+		return c.ToURL(v)
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
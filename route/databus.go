@@ -1,11 +1,13 @@
 package route
 
 import (
-	// "fmt"
+	"fmt"
 	"reflect"
+	"sync"
 )
 
-var gInjectFieldCache map[reflect.Type][]string = make(map[reflect.Type][]string)
+// Field metadata of the bus types, reflect.Type => *busType.
+var busTypes sync.Map
 
 type Databus interface {
 	Type(name string) reflect.Type
@@ -16,74 +18,156 @@ type Databus interface {
 	Fields() []string
 }
 
+// busType is the field metadata of a bus struct type. It is built once, when
+// a route of the type is registered, and never modified: the requests read
+// it without lock.
+type busType struct {
+	typ reflect.Type
+	// Fields by name, with the ones promoted from embedded structs.
+	fields map[string]*busField
+	// The databus fields, injected by the services.
+	inject []string
+	// The fields filled from the request, see busTag.
+	bound []string
+	// Error of an invalid bmgo tag, reported by busPlan.
+	err error
+}
+
+type busField struct {
+	// Index sequence for reflect.Value.FieldByIndex.
+	index []int
+	typ   reflect.Type
+	// Options of the bmgo tag, nil if there is none.
+	tag *busTag
+}
+
 type databus struct {
 	wv reflect.Value
-	wt reflect.Type
+	bt *busType
 }
 
-func cacheInjectFields(t reflect.Type) {
-	if _, ok := gInjectFieldCache[t]; ok {
-		return
+// getBusType returns the field metadata of the struct type t.
+func getBusType(t reflect.Type) *busType {
+	if bt, ok := busTypes.Load(t); ok {
+		return bt.(*busType)
 	}
+	bt, _ := busTypes.LoadOrStore(t, newBusType(t))
+	return bt.(*busType)
+}
 
-	fs := []string{}
+func newBusType(t reflect.Type) *busType {
+	bt := &busType{typ: t, fields: map[string]*busField{}}
+	for _, name := range fieldNames(t, nil, map[reflect.Type]bool{}) {
+		if _, ok := bt.fields[name]; ok {
+			continue
+		}
+		//同名 field 按 FieldByName 的规则: 外层覆盖内层, 同层有歧义的不可见
+		sf, ok := t.FieldByName(name)
+		if !ok {
+			continue
+		}
+		f := &busField{index: sf.Index, typ: sf.Type}
+		bt.fields[name] = f
+		//nil 的内嵌指针不注入
+		if throughPointer(t, sf.Index) {
+			continue
+		}
+		tag, err := parseBusTag(sf.Tag.Get("bmgo"), sf.Type)
+		if err != nil {
+			if bt.err == nil {
+				bt.err = fmt.Errorf("%v on the field %q of %s", err, name, t)
+			}
+			continue
+		}
+		f.tag = tag
+		if tag == nil {
+			continue
+		}
+		if tag.databus {
+			bt.inject = append(bt.inject, name)
+		} else {
+			bt.bound = append(bt.bound, name)
+		}
+	}
+	return bt
+}
+
+// fieldNames appends the names of the fields of t and of its embedded
+// structs, e.g. a base controller embedding beego.Controller.
+func fieldNames(t reflect.Type, names []string, seen map[reflect.Type]bool) []string {
+	seen[t] = true
 	for i := 0; i < t.NumField(); i++ {
 		f := t.Field(i)
-		if f.Tag.Get("bmgo") == "databus" {
-			fs = append(fs, f.Name)
+		names = append(names, f.Name)
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct && !seen[ft] {
+			names = fieldNames(ft, names, seen)
 		}
 	}
+	return names
+}
 
-	if len(fs) > 0 {
-		gInjectFieldCache[t] = fs
+// throughPointer returns true if the field at index is in an embedded
+// pointer.
+func throughPointer(t reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		t = t.Field(i).Type
+		if t.Kind() == reflect.Ptr {
+			return true
+		}
 	}
+	return false
 }
 
 func WrapperBusValue(v reflect.Value) Databus {
-	wv := v
-	wt := reflect.TypeOf(v)
-
-	if wv.Kind() == reflect.Ptr {
-		wv = wv.Elem()
-		wt = wv.Type()
-	} else {
-		//fmt.Printf("WrapperBusValue,v.kind=%s\n", wv.Kind().String())
+	if v.Kind() != reflect.Ptr {
+		//fmt.Printf("WrapperBusValue,v.kind=%s\n", v.Kind().String())
 		panic("WrapperBus v must Pointer")
 	}
-	cacheInjectFields(wt)
-	return &databus{wv: wv, wt: wt}
+	wv := v.Elem()
+	return &databus{wv: wv, bt: getBusType(wv.Type())}
 }
 
 func WrapperBus(v interface{}) Databus {
-	wv := reflect.ValueOf(v)
-	wt := reflect.TypeOf(v)
+	return WrapperBusValue(reflect.ValueOf(v))
+}
 
-	if wv.Kind() == reflect.Ptr {
-		wv = wv.Elem()
-		wt = wv.Type()
-		return &databus{wv: wv, wt: wt}
-	} else {
-		panic("WrapperBus v must Pointer")
+// field returns the field with the name, or the zero Value if there is none.
+func (bus *databus) field(name string) reflect.Value {
+	f := bus.bt.fields[name]
+	if f == nil {
+		return reflect.Value{}
+	}
+	if len(f.index) == 1 {
+		return bus.wv.Field(f.index[0])
 	}
+	return bus.wv.FieldByIndex(f.index)
 }
 
 func (bus *databus) Type(name string) reflect.Type {
-	f := bus.wv.FieldByName(name)
-	return f.Type()
+	if f := bus.bt.fields[name]; f != nil {
+		return f.typ
+	}
+	return nil
 }
 
 func (bus *databus) Value(name string) reflect.Value {
-	f := bus.wv.FieldByName(name)
-	return f
+	return bus.field(name)
 }
 
 func (bus *databus) Has(name string) bool {
-	f := bus.wv.FieldByName(name)
-	return f.Kind() != reflect.Invalid
+	_, ok := bus.bt.fields[name]
+	return ok
 }
 
 func (bus *databus) Get(name string) interface{} {
-	f := bus.wv.FieldByName(name)
+	f := bus.field(name)
 	if f.IsValid() {
 		return f.Interface()
 	} else {
@@ -92,17 +176,14 @@ func (bus *databus) Get(name string) interface{} {
 }
 
 func (bus *databus) Set(name string, v interface{}) {
-	f := bus.wv.FieldByName(name)
-	///vv := reflect.ValueOf(v)
+	f := bus.field(name)
 	if v == nil {
 		f.Set(reflect.Zero(f.Type()))
-		//f.Set(nil)
 	} else {
 		f.Set(reflect.ValueOf(v))
 	}
 }
 
 func (bus *databus) Fields() []string {
-	s, _ := gInjectFieldCache[bus.wt]
-	return s
+	return bus.bt.inject
 }
@@ -1,7 +1,18 @@
 package route
 
 import (
+	"errors"
+	"fmt"
+	"github.com/smithfox/beego/context"
+	"github.com/smithfox/beego/middleware"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -64,3 +75,373 @@ func Test_PtrStruct(t *testing.T) {
 	}
 	//expect(t, td.Embstruct, nil)
 }
+
+type userHandler struct {
+	User   string `bmgo:"databus"`
+	DB     string
+	Config string
+	Cache  string
+}
+
+func (h *userHandler) ServeContext(ctx *context.Context) {
+	ctx.WriteString(h.User)
+}
+
+type cacheHandler struct {
+	Cache string `bmgo:"databus"`
+}
+
+func (h *cacheHandler) ServeContext(ctx *context.Context) {}
+
+func Test_ServiceDependencies(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var calls []string
+	service := func(name, value string) DatabusService {
+		return func(ctx *context.Context, bus Databus) error {
+			calls = append(calls, name)
+			bus.Set(name, value+fmt.Sprint(bus.Get("DB")))
+			return nil
+		}
+	}
+	r := NewRouter(false)
+	// User is declared before DB, its dependency.
+	expect(t, r.AddService("User", service("User", "user@"), "DB"), nil)
+	expect(t, r.AddService("DB", service("DB", "db"), "Config"), nil)
+	expect(t, r.AddService("Cache", service("Cache", "cache")), nil)
+
+	// Config has no service yet: the route fails its requests, reported by
+	// Validate, until it is added.
+	route := r.Get("/user", &userHandler{})
+	expect(t, route.GetError(), nil)
+	refute(t, r.Validate(), nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/user"))
+	expect(t, w.Code, http.StatusInternalServerError)
+
+	expect(t, r.AddService("Config", func(*context.Context, Databus) error { return nil }), nil)
+	expect(t, r.Validate(), nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/user"))
+	expect(t, w.Body.String(), "user@db")
+	// Cache is not needed by the handler.
+	expect(t, strings.Join(calls, ","), "DB,User")
+
+	// DB is not a field of cacheHandler.
+	expect(t, r.AddService("Cache", service("Cache", "cache"), "DB"), nil)
+	r.Get("/cache", &cacheHandler{})
+	if err := r.Validate(); err == nil || !strings.Contains(err.Error(), `"/cache"`) {
+		t.Errorf("Validate must report the dependency of Cache, got %v", err)
+	}
+
+	err := r.AddService("Config", func(*context.Context, Databus) error { return nil }, "User")
+	refute(t, err, nil)
+	if err != nil && !strings.Contains(err.Error(), "Config -> User -> DB -> Config") {
+		t.Errorf("cycle error: %v", err)
+	}
+	// The cycle was not registered.
+	expect(t, r.Get("/user3", &userHandler{}).GetError(), nil)
+}
+
+func Test_ServiceErrors(t *testing.T) {
+	defer delete(middleware.ErrorMaps, "401")
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var user string
+	r := NewRouter(false)
+	r.AddService("DB", func(*context.Context, Databus) error { return nil })
+	r.AddService("User", func(ctx *context.Context, bus Databus) error {
+		switch user {
+		case "":
+			return middleware.NewHTTPError(http.StatusUnauthorized, "")
+		case "admin":
+			ctx.RedirectFound("/admin")
+			return nil
+		case "broken":
+			return errors.New("session store is down")
+		}
+		bus.Set("User", user)
+		return nil
+	}, "DB")
+	r.Get("/user", &userHandler{})
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newRequest("GET", "http://localhost/user"))
+		return w
+	}
+
+	w := serve()
+	expect(t, w.Code, http.StatusUnauthorized)
+	expect(t, w.Body.String(), "Unauthorized\n")
+
+	middleware.Errorhandler("401", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("please log in"))
+	})
+	expect(t, serve().Body.String(), "please log in")
+
+	user = "broken"
+	w = serve()
+	expect(t, w.Code, http.StatusInternalServerError)
+	expect(t, w.Body.String(), "Internal Server Error\n")
+
+	// The service wrote the response, the handler does not run.
+	user = "admin"
+	w = serve()
+	expect(t, w.Code, http.StatusFound)
+	expect(t, w.Header().Get("Location"), "/admin")
+
+	user = "bob"
+	expect(t, serve().Body.String(), "bob")
+}
+
+type busStruct struct {
+	A int `bmgo:"databus"`
+	Embstruct
+	B   *Embstruct `bmgo:"databus"`
+	Dep string
+}
+
+func Test_BusTypeConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v := &busStruct{}
+			bus := WrapperBus(v)
+			bus.Set("A", i)
+			bus.Set("Dep2", i)
+			if v.A != i || v.Dep2 != i {
+				t.Errorf("Set: %+v", v)
+			}
+			expect(t, strings.Join(bus.Fields(), ","), "A,B")
+			expect(t, bus.Type("Dep2"), reflect.TypeOf(0))
+			expect(t, bus.Has("Embstruct"), true)
+			expect(t, bus.Has("C"), false)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// The lookups done by the bus before the field metadata was cached.
+func BenchmarkBusFieldByName(b *testing.B) {
+	b.ReportAllocs()
+	v := reflect.ValueOf(&busStruct{}).Elem()
+	for i := 0; i < b.N; i++ {
+		v.FieldByName("Dep").Set(reflect.ValueOf("db"))
+		v.FieldByName("Dep2").Interface()
+	}
+}
+
+func BenchmarkBusGetSet(b *testing.B) {
+	b.ReportAllocs()
+	bus := WrapperBus(&busStruct{})
+	for i := 0; i < b.N; i++ {
+		bus.Set("Dep", "db")
+		bus.Get("Dep2")
+	}
+}
+
+type fakeDB struct {
+	name string
+}
+
+type fakeConn struct {
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+type seq int
+
+type providedHandler struct {
+	Read  *fakeDB   `bmgo:"databus"`
+	Write *fakeDB   `bmgo:"databus"`
+	Conn  *fakeConn `bmgo:"databus"`
+	Tx    *fakeConn `bmgo:"databus"`
+	Seq1  seq       `bmgo:"databus"`
+	Seq2  seq       `bmgo:"databus"`
+}
+
+var lastProvided *providedHandler
+
+func (h *providedHandler) ServeContext(ctx *context.Context) {
+	lastProvided = h
+	ctx.WriteString(fmt.Sprint(h.Conn.closed))
+}
+
+func Test_Providers(t *testing.T) {
+	var dbs, conns, seqs int
+	r := NewRouter(false)
+	r.ProvideType(reflect.TypeOf((*fakeDB)(nil)), Provider{
+		Scope: ScopeSingleton,
+		New: func(*context.Context, Databus) (interface{}, error) {
+			dbs++
+			return &fakeDB{}, nil
+		},
+	})
+	r.ProvideType(reflect.TypeOf((*fakeConn)(nil)), Provider{
+		New: func(*context.Context, Databus) (interface{}, error) {
+			conns++
+			return &fakeConn{}, nil
+		},
+	})
+	r.ProvideType(reflect.TypeOf(seq(0)), Provider{
+		Scope: ScopeTransient,
+		New: func(*context.Context, Databus) (interface{}, error) {
+			seqs++
+			return seq(seqs), nil
+		},
+	})
+	expect(t, r.Get("/provided", &providedHandler{}).GetError(), nil)
+
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newRequest("GET", "http://localhost/provided"))
+		// Released after the handler.
+		expect(t, w.Body.String(), "false")
+		h := lastProvided
+		expect(t, h.Read, h.Write)
+		expect(t, h.Conn, h.Tx)
+		expect(t, h.Conn.closed, true)
+		refute(t, h.Seq1, h.Seq2)
+		expect(t, conns, i)
+	}
+	expect(t, dbs, 1)
+	expect(t, seqs, 4)
+
+	// The name wins over the type.
+	r.Provide("Write", Provider{
+		Scope: ScopeTransient,
+		New: func(*context.Context, Databus) (interface{}, error) {
+			return &fakeDB{}, nil
+		},
+	})
+	r.Get("/provided2", &providedHandler{})
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/provided2"))
+	if lastProvided.Read == lastProvided.Write {
+		t.Errorf("Write must not be the singleton")
+	}
+
+	// A provided value of the wrong type is a server error.
+	r.Provide("Write", Provider{
+		New: func(*context.Context, Databus) (interface{}, error) {
+			return "db", nil
+		},
+	})
+	r.Get("/provided3", &providedHandler{})
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/provided3"))
+	expect(t, w.Code, http.StatusInternalServerError)
+}
+
+type boundHandler struct {
+	ID     int      `bmgo:"param=id"`
+	Page   uint     `bmgo:"query=page,default=1"`
+	Tags   []string `bmgo:"form=tag"`
+	Ratio  *float64 `bmgo:"query=ratio"`
+	Lang   string   `bmgo:"header=accept-language"`
+	Read   *fakeDB  `bmgo:"databus,name=ReadDB"`
+	Cache  *fakeDB  `bmgo:"databus,optional"`
+	Viewer string   `bmgo:"databus"`
+}
+
+func (h *boundHandler) ServeContext(ctx *context.Context) {
+	ratio := "nil"
+	if h.Ratio != nil {
+		ratio = fmt.Sprint(*h.Ratio)
+	}
+	ctx.WriteString(fmt.Sprintf("%d %d %v %s %s %s %v %s", h.ID, h.Page, h.Tags, ratio, h.Lang, h.Read.name, h.Cache == nil, h.Viewer))
+}
+
+func Test_BusTags(t *testing.T) {
+	r := NewRouter(false)
+	r.Provide("ReadDB", Provider{
+		Scope: ScopeSingleton,
+		New: func(*context.Context, Databus) (interface{}, error) {
+			return &fakeDB{name: "replica"}, nil
+		},
+	})
+	// Services may depend on the fields bound to the request.
+	r.AddService("Viewer", func(ctx *context.Context, bus Databus) error {
+		bus.Set("Viewer", fmt.Sprintf("viewer%d", bus.Get("ID")))
+		return nil
+	}, "ID")
+	expect(t, r.Get("/bound/{id}", &boundHandler{}).GetError(), nil)
+	serve := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := newRequest("GET", url)
+		req.Header.Set("Accept-Language", "fr")
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	expect(t, serve("http://localhost/bound/7?tag=a&tag=b&ratio=0.5").Body.String(), "7 1 [a b] 0.5 fr replica true viewer7")
+	expect(t, serve("http://localhost/bound/8?page=3").Body.String(), "8 3 [] nil fr replica true viewer8")
+
+	w := serve("http://localhost/bound/x")
+	expect(t, w.Code, http.StatusBadRequest)
+	if !strings.HasPrefix(w.Body.String(), `invalid param "id": `) {
+		t.Errorf("unexpected 400 body %q", w.Body.String())
+	}
+	w = serve("http://localhost/bound/1?page=-1")
+	expect(t, w.Code, http.StatusBadRequest)
+	if !strings.HasPrefix(w.Body.String(), `invalid query "page": `) {
+		t.Errorf("unexpected 400 body %q", w.Body.String())
+	}
+
+	type badTag struct {
+		A int `bmgo:"cookie=a"`
+	}
+	type badDefault struct {
+		A int `bmgo:"query=a,default=x"`
+	}
+	type badType struct {
+		A map[string]string `bmgo:"query=a"`
+	}
+	type missingAlias struct {
+		A *fakeDB `bmgo:"databus,name=WriteDB"`
+	}
+	for _, h := range []interface{}{&badTag{}, &badDefault{}, &badType{}, &missingAlias{}} {
+		_, err := busPlan(r.loadServices(), getBusType(reflect.TypeOf(h).Elem()))
+		refute(t, err, nil)
+	}
+}
+
+type panicHandler struct {
+	Conn *fakeConn `bmgo:"databus"`
+	Boom string    `bmgo:"databus"`
+}
+
+func (h *panicHandler) ServeContext(ctx *context.Context) {}
+
+func Test_ProviderReleaseOnPanic(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	var conn *fakeConn
+	r := NewRouter(false)
+	r.ProvideType(reflect.TypeOf((*fakeConn)(nil)), Provider{
+		New: func(*context.Context, Databus) (interface{}, error) {
+			conn = &fakeConn{}
+			return conn, nil
+		},
+	})
+	r.AddService("Boom", func(*context.Context, Databus) error {
+		panic("boom")
+	}, "Conn")
+	r.Get("/panic", &panicHandler{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/panic"))
+	expect(t, w.Code, http.StatusInternalServerError)
+	refute(t, conn, (*fakeConn)(nil))
+	expect(t, conn.closed, true)
+}
@@ -0,0 +1,214 @@
+package route
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Group returns a sub-router for the routes under the path prefix.
+//
+// Routes registered on the group inherit its prefix, Host template,
+// OnlyScheme and CheckCsrf/CheckAuth flags. They are matched by the root
+// router, in registration order, with all the other routes.
+//
+// A group has its own filters and middlewares, run after one of its routes
+// matched, and its own NotFoundHandler, used when the request is under the group but no route
+// matches. Groups can be nested:
+//
+//     api := r.Group("/api")
+//     v1 := api.Group("/v1").CheckAuth()
+//     v1.Get("/users/{id}", &UserHandler{})   // matches /api/v1/users/{id}
+//
+// The prefix must start with a slash, else the group keeps the error and its
+// routes fail to build, see Validate.
+func (r *Router) Group(prefix string) *Router {
+	g := r.newGroup()
+	if prefix != "" && prefix[0] != '/' {
+		g.groupErr = fmt.Errorf("mux: group prefix must start with a slash, got %q", prefix)
+		if g.root().StrictRoutes {
+			panic(g.groupErr)
+		}
+		return g
+	}
+	g.prefix = joinPathTemplate(r.prefix, prefix)
+	g.compileGroup()
+	return g
+}
+
+// Host returns a sub-router for the routes matching the host template,
+// see HandlerRouteItem.Host(). It serves a virtual host: its routes are
+// matched with all the other routes in registration order, so a route
+// without host registered earlier shadows the host's routes for its path.
+// Its NotFoundHandler is used for the requests to the host, a static host
+// winning over a host template. The host variables are in the RouteParams:
+//
+//     tenant := r.Host("{tenant}.example.com")
+//     tenant.Get("/", &TenantHome{})
+func (r *Router) Host(tpl string) *Router {
+	g := r.newGroup()
+	g.host = tpl
+	g.compileGroup()
+	return g
+}
+
+// OnlyScheme sets the scheme of the routes registered later on the group,
+// see HandlerRouteItem.OnlyScheme().
+func (r *Router) OnlyScheme(scheme string) *Router {
+	r.onlyscheme = strings.ToLower(scheme)
+	return r
+}
+
+// CheckCsrf sets the csrf flag of the routes registered later on the group.
+func (r *Router) CheckCsrf() *Router {
+	r.checkCsrf = true
+	return r
+}
+
+// CheckAuth sets the auth flag of the routes registered later on the group.
+func (r *Router) CheckAuth() *Router {
+	r.checkAuth = true
+	return r
+}
+
+func (r *Router) newGroup() *Router {
+	g := &Router{
+		parent:          r,
+		depth:           r.depth + 1,
+		prefix:          r.prefix,
+		host:            r.host,
+		onlyscheme:      r.onlyscheme,
+		checkCsrf:       r.checkCsrf,
+		checkAuth:       r.checkAuth,
+		httphost:        r.httphost,
+		httpshost:       r.httpshost,
+		enable_to_https: r.enable_to_https,
+		EnableGzip:      r.EnableGzip,
+	}
+	r.editTable(false, func(t *routeTable) error {
+		t.groups = append(t.groups, g)
+		return nil
+	})
+	return g
+}
+
+// compileGroup builds the regexps used to decide whether a request is
+// under the group. An error is kept in groupErr, the routes registered on
+// the group and its subgroups get it, see initRouteItem.
+func (r *Router) compileGroup() {
+	if r.parent.groupErr != nil {
+		r.groupErr = r.parent.groupErr
+		return
+	}
+	defer func() {
+		if r.groupErr != nil && r.root().StrictRoutes {
+			panic(r.groupErr)
+		}
+	}()
+	r.hostRegexp, r.prefixRegexp = nil, nil
+	if r.host != "" {
+		if r.hostRegexp, r.groupErr = newRouteRegexp(r.host, true, false, false); r.groupErr != nil {
+			return
+		}
+	}
+	if r.prefix != "" {
+		if r.prefix[0] != '/' {
+			r.groupErr = fmt.Errorf("mux: path must start with a slash, got %q", r.prefix)
+			return
+		}
+		if r.prefixRegexp, r.groupErr = newRouteRegexp(r.prefix, false, true, false); r.groupErr != nil {
+			return
+		}
+		//前缀只匹配整段: /api 匹配 /api 和 /api/x, 不匹配 /apiary
+		if !strings.HasSuffix(r.prefix, "/") {
+			r.prefixRegexp.regexp = regexp.MustCompile(r.prefixRegexp.regexp.String() + "(?:/|$)")
+		}
+	}
+}
+
+// inGroup returns true if the request is under the group.
+func (r *Router) inGroup(req *http.Request) bool {
+	if r.groupErr != nil {
+		return false
+	}
+	if r.hostRegexp != nil && !r.hostRegexp.Match(req) {
+		return false
+	}
+	if r.prefixRegexp != nil && !r.prefixRegexp.Match(req) {
+		return false
+	}
+	return true
+}
+
+// hostRank ranks the host of the group as the route index does: 2 for a
+// static host, 1 for a template with variables, 0 without host.
+func (r *Router) hostRank() int {
+	if r.hostRegexp == nil {
+		return 0
+	}
+	if len(r.hostRegexp.varsN) == 0 {
+		return 2
+	}
+	return 1
+}
+
+// root returns the router which holds the routes of all its groups.
+func (r *Router) root() *Router {
+	for r.parent != nil {
+		r = r.parent
+	}
+	return r
+}
+
+// initRouteItem applies the defaults of the group to a new route item.
+func (r *Router) initRouteItem(routeitem *HandlerRouteItem) {
+	routeitem.Router = r
+	routeitem.onlyscheme = r.onlyscheme
+	routeitem.checkCsrf = r.checkCsrf
+	routeitem.checkAuth = r.checkAuth
+	if r.groupErr != nil {
+		routeitem.setError(r.groupErr)
+	}
+	if r.host != "" {
+		routeitem.Host(r.host)
+	}
+}
+
+// notFoundHandler returns the NotFoundHandler of the innermost group the
+// request is under, or the one of the root router. Between groups of the
+// same depth, a static host wins over a host template.
+func (r *Router) notFoundHandler(req *http.Request) http.Handler {
+	var found *Router
+	for _, g := range r.loadTable().groups {
+		if g.NotFoundHandler == nil {
+			continue
+		}
+		if found != nil && (found.depth > g.depth || found.depth == g.depth && found.hostRank() >= g.hostRank()) {
+			continue
+		}
+		if g.inGroup(req) {
+			found = g
+		}
+	}
+	if found != nil {
+		return found.NotFoundHandler
+	}
+	if r.NotFoundHandler == nil {
+		r.NotFoundHandler = http.NotFoundHandler()
+	}
+	return r.NotFoundHandler
+}
+
+// groupMember is implemented by route items registered on a router.
+type groupMember interface {
+	group() *Router
+}
+
+// joinPathTemplate appends a path template to a prefix template.
+func joinPathTemplate(prefix, tpl string) string {
+	if prefix == "" {
+		return tpl
+	}
+	return strings.TrimRight(prefix, "/") + tpl
+}
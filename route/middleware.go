@@ -0,0 +1,166 @@
+package route
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Filter positions, see Router.InsertFilter.
+const (
+	// Before the routes are matched, the route is not known yet.
+	BeforeRouter = iota
+	// After a route matched, before its handler is created and run.
+	BeforeExec
+	// After the handler of the matched route ran.
+	AfterExec
+	// At the end of the request, also when no route matched or a filter
+	// stopped it.
+	FinishRouter
+)
+
+// Middleware wraps the handler of a matched route, whatever its kind
+// (http.Handler, ContextHandler or Controller).
+// The matched route and its params are available with CurrentRoute and
+// CurrentParams.
+type Middleware func(http.Handler) http.Handler
+
+// routeMatch is stored in the request context once a route matched.
+type routeMatch struct {
+	route  RouteItem
+	params RouteParams
+}
+
+type contextKey int
+
+const routeMatchKey contextKey = 0
+
+// CurrentRoute returns the route matched for the request, or nil.
+func CurrentRoute(req *http.Request) RouteItem {
+	if m, ok := req.Context().Value(routeMatchKey).(*routeMatch); ok {
+		return m.route
+	}
+	return nil
+}
+
+// CurrentParams returns the params of the route matched for the request.
+func CurrentParams(req *http.Request) RouteParams {
+	if m, ok := req.Context().Value(routeMatchKey).(*routeMatch); ok {
+		return m.params
+	}
+	return nil
+}
+
+// withRouteMatch returns the request carrying the matched route and params.
+func withRouteMatch(req *http.Request, routeitem RouteItem) *http.Request {
+	m := &routeMatch{route: routeitem, params: routeitem.GetRouteParams(req)}
+	return req.WithContext(context.WithValue(req.Context(), routeMatchKey, m))
+}
+
+// requestRouteParams returns the params of routeitem for the request, from
+// the match stored by the router if any.
+func requestRouteParams(routeitem RouteItem, req *http.Request) RouteParams {
+	if m, ok := req.Context().Value(routeMatchKey).(*routeMatch); ok && m.route == routeitem {
+		return m.params
+	}
+	return routeitem.GetRouteParams(req)
+}
+
+// InsertFilter adds a filter at the given position.
+//
+// The filters of a group only run for the requests routed to one of its
+// routes, so its BeforeRouter filters run with its BeforeExec filters.
+// Filters of outer groups run first, a filter returning false stops the
+// request, or the remaining filters at AfterExec and FinishRouter.
+//
+// An invalid position is reported by Validate, the filter is dropped. It
+// panics if StrictRoutes is set.
+func (r *Router) InsertFilter(pos int, filter Filter) {
+	if pos < BeforeRouter || pos > FinishRouter {
+		err := fmt.Errorf("mux: invalid filter position %d", pos)
+		if r.root().StrictRoutes {
+			panic(err)
+		}
+		if r.filterErr == nil {
+			r.filterErr = err
+		}
+		return
+	}
+	r.filters[pos] = append(r.filters[pos], filter)
+}
+
+// InsertFilterFunc adds a filter function at the given position.
+func (r *Router) InsertFilterFunc(pos int, f func(http.ResponseWriter,
+	*http.Request) bool) {
+	r.InsertFilter(pos, FilterFunc(f))
+}
+
+// Use adds middlewares wrapping the handlers of all the routes of the router
+// or group. Middlewares of the router run before those of its groups, and
+// those run before the middlewares of the route.
+func (r *Router) Use(mws ...Middleware) *Router {
+	r.middlewares = append(r.middlewares, mws...)
+	return r
+}
+
+// routerChain returns the root router and the groups of the route, outer
+// groups first.
+func (r *Router) routerChain(routeitem RouteItem) []*Router {
+	gm, ok := routeitem.(groupMember)
+	if !ok {
+		return []*Router{r}
+	}
+	var chain []*Router
+	for g := gm.group(); g != nil; g = g.parent {
+		chain = append(chain, g)
+	}
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// runFilters runs the filters of the chain at the given position.
+// The BeforeRouter filters of the root router are not part of it, they run
+// before the match.
+func runFilters(chain []*Router, pos int, w http.ResponseWriter, req *http.Request) bool {
+	for _, g := range chain {
+		if pos == BeforeExec && g.parent != nil {
+			for _, filter := range g.filters[BeforeRouter] {
+				if ok := filter.FilterHTTP(w, req); !ok {
+					return false
+				}
+			}
+		}
+		for _, filter := range g.filters[pos] {
+			if ok := filter.FilterHTTP(w, req); !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// wrapMiddlewares wraps the handler of the route with the middlewares of the
+// route, then of its groups, then of the root router.
+func wrapMiddlewares(chain []*Router, routeitem RouteItem, handler http.Handler) http.Handler {
+	if mh, ok := routeitem.(middlewareHolder); ok {
+		handler = wrapHandler(mh.routeMiddlewares(), handler)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		handler = wrapHandler(chain[i].middlewares, handler)
+	}
+	return handler
+}
+
+func wrapHandler(mws []Middleware, handler http.Handler) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+	return handler
+}
+
+// middlewareHolder is implemented by route items accepting middlewares.
+type middlewareHolder interface {
+	routeMiddlewares() []Middleware
+}
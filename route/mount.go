@@ -0,0 +1,144 @@
+package route
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const mountKey contextKey = 1
+
+// Mount serves handler, an http.Handler application like an admin panel,
+// for the paths under prefix, with any method. The handler sees the paths
+// relative to the mount point: "/admin/users" is served as "/users", and
+// "/admin" is redirected to "/admin/".
+//
+// The stripped prefix is added to the X-Forwarded-Prefix header, and the
+// original path is returned by MountedPath. The prefix may contain
+// variables, available with CurrentParams:
+//
+//     r.Mount("/admin", adminApp)
+//     r.Mount("/t/{tenant}/metrics", metricsUI)
+func (r *Router) Mount(prefix string, handler http.Handler) *HandlerRouteItem {
+	if prefix = strings.TrimRight(prefix, "/"); prefix == "" {
+		prefix = "/"
+	}
+	routeitem := r.newHandlerRouteItem()
+	m := &mountHandler{routeitem: routeitem, handler: handler}
+	routeitem.PathPrefix(prefix).addMatcher(m)
+	return r.addHandlerRoute(routeitem.Handler(m))
+}
+
+// MountedPath returns the path of the request before the prefix of the
+// mounted handlers was stripped, see Router.Mount. It returns the path of
+// the request if it was not served by a mounted handler.
+func MountedPath(req *http.Request) string {
+	if path, ok := req.Context().Value(mountKey).(string); ok {
+		return path
+	}
+	return req.URL.Path
+}
+
+// mountHandler strips the prefix of a mounted handler. It is also a matcher
+// of its route: the prefix must end at a slash, "/admin" does not mount
+// "/administrator".
+type mountHandler struct {
+	routeitem *HandlerRouteItem
+	handler   http.Handler
+}
+
+// split returns the length of the prefix matched in path.
+func (m *mountHandler) split(path string) (int, bool) {
+	return splitPrefix(m.routeitem.pathRegexp(), path)
+}
+
+// splitPrefix returns the length of the path prefix rr matched in path. The
+// prefix must end at a slash: "/admin" matches "/admin/users", not
+// "/administrator".
+func splitPrefix(rr *routeRegexp, path string) (int, bool) {
+	if rr == nil {
+		return 0, false
+	}
+	loc := rr.regexp.FindStringIndex(path)
+	if loc == nil {
+		return 0, false
+	}
+	if n := loc[1]; n > 0 && path[n-1] == '/' {
+		// The prefix is the root.
+		return n - 1, true
+	}
+	if rest := path[loc[1]:]; rest != "" && rest[0] != '/' {
+		return 0, false
+	}
+	return loc[1], true
+}
+
+func (m *mountHandler) Match(req *http.Request) bool {
+	_, ok := m.split(req.URL.Path)
+	return ok
+}
+
+func (m *mountHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n, ok := m.split(req.URL.Path)
+	if !ok {
+		m.routeitem.Router.root().notFoundHandler(req).ServeHTTP(w, req)
+		return
+	}
+	if n == len(req.URL.Path) {
+		u := *req.URL
+		u.Path += "/"
+		if u.RawPath != "" {
+			u.RawPath += "/"
+		}
+		//同 RedirectSlash, 用 307 以保留 POST
+		http.Redirect(w, req, u.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	prefix := req.URL.Path[:n]
+	u := *req.URL
+	u.Path = req.URL.Path[n:]
+	u.RawPath = ""
+	if req.URL.RawPath != "" {
+		u.RawPath = stripRawPrefix(req.URL.RawPath, prefix)
+	}
+
+	// The X-Forwarded-Prefix of the client is dropped, the one of an outer
+	// mount is kept.
+	ctx := req.Context()
+	forwardedPrefix := prefix
+	if _, ok := ctx.Value(mountKey).(string); ok {
+		forwardedPrefix = req.Header.Get("X-Forwarded-Prefix") + prefix
+	} else {
+		ctx = context.WithValue(ctx, mountKey, req.URL.Path)
+	}
+	sub := req.WithContext(ctx)
+	sub.URL = &u
+	sub.RequestURI = u.RequestURI()
+	sub.Header = req.Header.Clone()
+	sub.Header.Set("X-Forwarded-Prefix", forwardedPrefix)
+	m.handler.ServeHTTP(w, sub)
+}
+
+// stripRawPrefix removes from the escaped path the part which unescapes to
+// prefix. It returns "" if there is none: the stripped path has no special
+// encoding then.
+func stripRawPrefix(rawpath, prefix string) string {
+	for i := 0; i < len(rawpath); i++ {
+		if rawpath[i] != '/' || i == 0 {
+			continue
+		}
+		p, err := url.PathUnescape(rawpath[:i])
+		if err != nil {
+			return ""
+		}
+		if p == prefix {
+			return rawpath[i:]
+		}
+		if len(p) > len(prefix) {
+			break
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+package route
+
+import (
+	"bufio"
+	"errors"
+	"github.com/smithfox/beego"
+	"github.com/smithfox/beego/middleware"
+	"github.com/smithfox/beego/recovery"
+	"log"
+	"net"
+	"net/http"
+)
+
+// responseTracker records whether the response was started, so a panic
+// recovered after it does not write a second response.
+type responseTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *responseTracker) WriteHeader(code int) {
+	w.written = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseTracker) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseTracker) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.written = true
+		f.Flush()
+	}
+}
+
+func (w *responseTracker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("route: the ResponseWriter can't be hijacked")
+	}
+	w.written = true
+	return h.Hijack()
+}
+
+// recoverPanic logs a panic recovered while serving the request and responds
+// with a 500, unless the response was already started: the error page of
+// middleware.ErrorMaps, or middleware.ShowErr with the stack in dev mode when
+// beego.RecoverPanic is set.
+//
+// http.ErrAbortHandler is panicked again, it aborts the response on purpose.
+func recoverPanic(err interface{}, w *responseTracker, req *http.Request) {
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	// Skip recoverPanic, the deferred function and runtime.gopanic.
+	stack := string(recovery.Stack(3))
+	log.Printf("Router ServeHTTP PANIC: %s\n%s\n", err, stack)
+	if w.written {
+		return
+	}
+	if beego.RecoverPanic && beego.RunMode == "dev" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		middleware.ShowErr(err, w, req, stack)
+		return
+	}
+	middleware.Exception("500", w, req, "Internal Server Error")
+}
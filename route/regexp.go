@@ -7,6 +7,7 @@ package route
 import (
 	"bytes"
 	"fmt"
+	"github.com/smithfox/beego/context"
 	"net/http"
 	// "net/url"
 	"regexp"
@@ -23,6 +24,9 @@ import (
 // Previously we accepted only Python-like identifiers for variable
 // names ([a-zA-Z_][a-zA-Z0-9_]*), but currently the only restriction is that
 // name and pattern can't be empty, and names can't contain a colon.
+//
+// The pattern can be the name of a registered Converter: {id:int},
+// {slug:slug}, {uuid:uuid} or {rest:path}, which spans slashes.
 func newRouteRegexp(tpl string, matchHost, matchPrefix, fuzzyMatchSlash bool) (*routeRegexp, error) {
 	// Check if it is well-formed.
 	idxs, errBraces := braceIndices(tpl)
@@ -48,6 +52,7 @@ func newRouteRegexp(tpl string, matchHost, matchPrefix, fuzzyMatchSlash bool) (*
 	}
 	varsN := make([]string, len(idxs)/2)
 	varsR := make([]*regexp.Regexp, len(idxs)/2)
+	varsC := make([]Converter, len(idxs)/2)
 	pattern := bytes.NewBufferString("^")
 	reverse := bytes.NewBufferString("")
 	var end int
@@ -67,6 +72,7 @@ func newRouteRegexp(tpl string, matchHost, matchPrefix, fuzzyMatchSlash bool) (*
 			return nil, fmt.Errorf("mux: missing name or pattern in %q",
 				tpl[idxs[i]:end])
 		}
+		patt, varsC[i/2] = varRegexp(patt)
 		// Build the regexp pattern.
 		fmt.Fprintf(pattern, "%s(%s)", regexp.QuoteMeta(raw), patt)
 		// Build the reverse template.
@@ -96,14 +102,23 @@ func newRouteRegexp(tpl string, matchHost, matchPrefix, fuzzyMatchSlash bool) (*
 	if errCompile != nil {
 		return nil, errCompile
 	}
+	// The literal part before the first variable, used by the route index.
+	prefix := tpl
+	if len(idxs) > 0 {
+		prefix = tpl[:idxs[0]]
+	}
 	// Done!
 	return &routeRegexp{
-		template:  template,
-		matchHost: matchHost,
-		regexp:    reg,
-		reverse:   reverse.String(),
-		varsN:     varsN,
-		varsR:     varsR,
+		template:    template,
+		matchHost:   matchHost,
+		matchPrefix: matchPrefix,
+		fuzzySlash:  fuzzyMatchSlash,
+		regexp:      reg,
+		reverse:     reverse.String(),
+		prefix:      prefix,
+		varsN:       varsN,
+		varsR:       varsR,
+		varsC:       varsC,
 	}, nil
 }
 
@@ -114,14 +129,22 @@ type routeRegexp struct {
 	template string
 	// True for host match, false for path match.
 	matchHost bool
+	// True for PathPrefix, the regexp is not anchored at the end.
+	matchPrefix bool
+	// True if an optional trailing slash is accepted.
+	fuzzySlash bool
 	// Expanded regexp.
 	regexp *regexp.Regexp
 	// Reverse template.
 	reverse string
+	// Static prefix of the template, every matched URL starts with it.
+	prefix string
 	// Variable names.
 	varsN []string
 	// Variable regexps (validators).
 	varsR []*regexp.Regexp
+	// Variable converters, nil for a plain regexp.
+	varsC []Converter
 }
 
 // Match matches the regexp against the URL host or path.
@@ -139,28 +162,34 @@ func (r *routeRegexp) Match(req *http.Request) bool {
 }
 
 // url builds a URL part using the given values.
-func (r *routeRegexp) url(pairs ...string) (string, error) {
-	values, err := mapFromPairs(pairs...)
+// Values of typed variables are formatted by their converter, other values
+// with fmt.Sprint.
+func (r *routeRegexp) url(pairs ...interface{}) (string, error) {
+	values, err := mapFromValuePairs(pairs...)
 	if err != nil {
 		return "", err
 	}
+	strValues := make([]string, len(r.varsN))
 	urlValues := make([]interface{}, len(r.varsN))
 	for k, v := range r.varsN {
 		value, ok := values[v]
 		if !ok {
 			return "", fmt.Errorf("mux: missing route variable %q", v)
 		}
-		urlValues[k] = value
+		if strValues[k], err = formatVar(r.varsC[k], value); err != nil {
+			return "", err
+		}
+		urlValues[k] = strValues[k]
 	}
 	rv := fmt.Sprintf(r.reverse, urlValues...)
 	if !r.regexp.MatchString(rv) {
 		// The URL is checked against the full regexp, instead of checking
 		// individual variables. This is faster but to provide a good error
 		// message, we check individual regexps if the URL doesn't match.
-		for k, v := range r.varsN {
-			if !r.varsR[k].MatchString(values[v]) {
+		for k := range r.varsN {
+			if !r.varsR[k].MatchString(strValues[k]) {
 				return "", fmt.Errorf(
-					"mux: variable %q doesn't match, expected %q", values[v],
+					"mux: variable %q doesn't match, expected %q", strValues[k],
 					r.varsR[k].String())
 			}
 		}
@@ -225,10 +254,11 @@ func (v *routeRegexpGroup) setMatch(req *http.Request, routeParams RouteParams)
 	}
 }
 
-// getHost tries its best to return the request host.
+// getHost returns the host of the request without port, the one told by a
+// trusted proxy if any.
 func getHost(r *http.Request) string {
 	if !r.URL.IsAbs() {
-		host := r.Host
+		host := context.RequestHost(r)
 		// Slice off any port information.
 		if i := strings.Index(host, ":"); i != -1 {
 			host = host[:i]
@@ -0,0 +1,208 @@
+package route
+
+import (
+	"strings"
+)
+
+// routeIndex is a compressed prefix tree (radix tree) built over the static
+// prefixes of the path templates, so Router.Match only tests the routes that
+// can possibly match the request path instead of scanning every route.
+//
+// Routes with a host template get their own trees: by host for the static
+// templates, and one per template for the templates with variables, whose
+// regexp is tested once per request instead of once per route. Only the
+// trees of the hosts matching the request are searched.
+//
+// The tree stores route positions, the candidates of all the trees are
+// merged and tested in registration order, so the first-match-wins
+// semantics of the linear scan are kept.
+type routeIndex struct {
+	// Routes without host.
+	root *indexNode
+	// Routes with a static host template, by host.
+	static map[string]*indexNode
+	// Routes with host variables, in registration order of the templates.
+	dynamic []*hostTree
+}
+
+type hostTree struct {
+	host *routeRegexp
+	root *indexNode
+}
+
+// indexEntry is one route stored in the tree.
+type indexEntry struct {
+	// Position of the route in routeTable.routes.
+	pos int
+	// The template has no variable and is not a PathPrefix: the route can
+	// only match the path ending at this node.
+	exact bool
+	// An optional trailing slash is accepted after an exact path.
+	fuzzySlash bool
+}
+
+type indexNode struct {
+	// Edge label, the part of the prefix between parent and this node.
+	label    string
+	children []*indexNode
+	entries  []indexEntry
+}
+
+// pathIndexer is implemented by route items which expose their host and path
+// regexps.
+type pathIndexer interface {
+	pathRegexp() *routeRegexp
+	hostPattern() *routeRegexp
+}
+
+func newRouteIndex(routes []RouteItem) *routeIndex {
+	idx := &routeIndex{root: &indexNode{}}
+	for pos, route := range routes {
+		e := indexEntry{pos: pos}
+		prefix := ""
+		tree := idx.root
+		if pi, ok := route.(pathIndexer); ok {
+			if rr := pi.pathRegexp(); rr != nil {
+				prefix = rr.prefix
+				e.exact = len(rr.varsN) == 0 && !rr.matchPrefix
+				e.fuzzySlash = rr.fuzzySlash
+			}
+			if host := pi.hostPattern(); host != nil {
+				tree = idx.hostTree(host)
+			}
+		}
+		tree.insert(prefix, e)
+	}
+	return idx
+}
+
+// hostTree returns the tree of the routes with the host template.
+func (idx *routeIndex) hostTree(host *routeRegexp) *indexNode {
+	if len(host.varsN) == 0 {
+		if idx.static == nil {
+			idx.static = make(map[string]*indexNode)
+		}
+		n, ok := idx.static[host.template]
+		if !ok {
+			n = &indexNode{}
+			idx.static[host.template] = n
+		}
+		return n
+	}
+	for _, t := range idx.dynamic {
+		if t.host.template == host.template {
+			return t.root
+		}
+	}
+	t := &hostTree{host: host, root: &indexNode{}}
+	idx.dynamic = append(idx.dynamic, t)
+	return t.root
+}
+
+// hasHosts returns true if some routes have a host template.
+func (idx *routeIndex) hasHosts() bool {
+	return len(idx.static) > 0 || len(idx.dynamic) > 0
+}
+
+// insert adds the entry under the given prefix, splitting edges as needed.
+func (n *indexNode) insert(prefix string, e indexEntry) {
+	for {
+		if prefix == "" {
+			n.entries = append(n.entries, e)
+			return
+		}
+		var child *indexNode
+		for _, c := range n.children {
+			if c.label[0] == prefix[0] {
+				child = c
+				break
+			}
+		}
+		if child == nil {
+			n.children = append(n.children, &indexNode{label: prefix, entries: []indexEntry{e}})
+			return
+		}
+		l := commonPrefixLen(child.label, prefix)
+		if l < len(child.label) {
+			// Split the edge: child keeps the tail of its label.
+			split := &indexNode{label: child.label[:l], children: []*indexNode{child}}
+			child.label = child.label[l:]
+			for i, c := range n.children {
+				if c == split.children[0] {
+					n.children[i] = split
+					break
+				}
+			}
+			child = split
+		}
+		n = child
+		prefix = prefix[l:]
+	}
+}
+
+// lookup returns the positions of the candidate routes for host and path,
+// from the trees of the matching hosts and of the routes without host,
+// sorted in registration order. buf is used as storage to avoid an
+// allocation.
+func (idx *routeIndex) lookup(host, path string, buf []int) []int {
+	cands := buf[:0]
+	if idx.hasHosts() {
+		if n, ok := idx.static[host]; ok {
+			cands = n.collect(path, cands)
+		}
+		for _, t := range idx.dynamic {
+			if t.host.regexp.MatchString(host) {
+				cands = t.root.collect(path, cands)
+			}
+		}
+	}
+	cands = idx.root.collect(path, cands)
+	sortPositions(cands)
+	return cands
+}
+
+// collect appends the entries of the tree which can match path.
+func (n *indexNode) collect(path string, cands []int) []int {
+	rest := path
+	for {
+		for _, e := range n.entries {
+			if e.exact && rest != "" && !(e.fuzzySlash && rest == "/") {
+				continue
+			}
+			cands = append(cands, e.pos)
+		}
+		if rest == "" {
+			break
+		}
+		var next *indexNode
+		for _, c := range n.children {
+			if c.label[0] == rest[0] {
+				next = c
+				break
+			}
+		}
+		if next == nil || !strings.HasPrefix(rest, next.label) {
+			break
+		}
+		rest = rest[len(next.label):]
+		n = next
+	}
+	return cands
+}
+
+// sortPositions is an insertion sort, the candidate lists are short.
+func sortPositions(cands []int) {
+	for i := 1; i < len(cands); i++ {
+		for j := i; j > 0 && cands[j] < cands[j-1]; j-- {
+			cands[j], cands[j-1] = cands[j-1], cands[j]
+		}
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
@@ -2,6 +2,7 @@ package route
 
 import (
 	"net/http"
+	"net/url"
 )
 
 type RouteParams map[string]string
@@ -35,4 +36,9 @@ type RouteItem interface {
 	//0-no,1-yes, otherwise no path
 	EndWithSlash() int
 	Match(req *http.Request) bool
+	MatchPath(req *http.Request) bool
+	MatchMethod(method string) bool
+	GetMethods() []string
+	GetName() string
+	URL(pairs ...string) (*url.URL, error)
 }
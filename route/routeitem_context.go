@@ -1,7 +1,6 @@
 package route
 
 import (
-	"fmt"
 	"github.com/smithfox/beego/context"
 	"net/http"
 	"reflect"
@@ -9,68 +8,157 @@ import (
 
 type ContextRouteItem struct {
 	HandlerRouteItem
-	createCtxHandler createCtxHandlerFunc
+	//每个 method 一个 handler, "*" 是 Any()
+	createCtxHandlers map[string]createCtxHandlerFunc
+	// Handler type names by method, see Router.Walk.
+	handlerNames map[string]string
+	// Databus plans of the handlers, see busError.
+	planners []*busPlanner
 }
 
+// methods accepted by ContextRouteItem.Any().
+var anyMethods = []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS"}
+
 func (r *ContextRouteItem) Path(tpl string) *ContextRouteItem {
-	r.err = r.addRegexpMatcher(tpl, false, false)
+	r.setError(r.addRegexpMatcher(tpl, false, false))
+	return r
+}
+
+// Name sets the name for the route, used to build URLs.
+func (r *ContextRouteItem) Name(name string) *ContextRouteItem {
+	r.setName(name, r)
+	return r
+}
+
+// Use adds middlewares wrapping the handler of the route.
+func (r *ContextRouteItem) Use(mws ...Middleware) *ContextRouteItem {
+	r.HandlerRouteItem.Use(mws...)
 	return r
 }
 
 func (r *ContextRouteItem) CreateHandler(w http.ResponseWriter, req *http.Request) http.Handler {
-	routeParams := r.GetRouteParams(req)
+	routeParams := requestRouteParams(r, req)
 	context := &context.Context{W: w, R: req, Param: routeParams, EnableGzip: r.Router.EnableGzip}
 	//fmt.Printf("ContextRouteItem\n")
-	return r.createCtxHandler(r.Router.services, context)
+	createCtxHandler := r.createCtxHandlers[req.Method]
+	if createCtxHandler == nil && req.Method == "HEAD" {
+		createCtxHandler = r.createCtxHandlers["GET"]
+	}
+	if createCtxHandler == nil {
+		createCtxHandler = r.createCtxHandlers["*"]
+	}
+	if createCtxHandler == nil {
+		return nil
+	}
+	return createCtxHandler(context)
+}
+
+// busError returns the error of the databus plan of a handler, if any: a
+// missing service fails its requests.
+func (r *ContextRouteItem) busError() error {
+	for _, p := range r.planners {
+		if _, _, err := p.plan(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Context --------------------------------------------------------------------
 
-func (r *ContextRouteItem) action(f ContextHandler) {
+func (r *ContextRouteItem) action(method string, f ContextHandler) {
 	rt := reflect.TypeOf(f)
 	if rt.Kind() != reflect.Ptr {
-		panic("RoutItem.Get parameter must pointer!")
+		panic("RoutItem." + method + " parameter must pointer!")
 	}
 
 	rt = rt.Elem()
 
-	r.createCtxHandler = func(services map[string]DatabusService, ctx *context.Context) http.Handler {
+	bt := getBusType(rt)
+	if bt.err != nil {
+		r.setError(bt.err)
+		return
+	}
+	planner := newBusPlanner(r.Router, bt)
+	r.planners = append(r.planners, planner)
+
+	if r.createCtxHandlers == nil {
+		r.createCtxHandlers = make(map[string]createCtxHandlerFunc)
+		r.handlerNames = make(map[string]string)
+	}
+	r.handlerNames[method] = rt.String()
+	r.createCtxHandlers[method] = func(ctx *context.Context) http.Handler {
 		//fmt.Printf("RouteItem.createCtxHandler\n")
 		vc := reflect.New(rt)
 		ci := vc.Interface()
-		bus := WrapperBusValue(vc)
+		bus := &databus{wv: vc.Elem(), bt: bt}
 		wch := &WrapperContextHandler{}
 		wch.context = ctx
 		wch.bus = bus
-		wch.services = services
+		wch.services, wch.plan, wch.planErr = planner.plan()
 		wch.handler = ci.(ContextHandler)
 
 		return wch
 	}
 }
 
-func (r *ContextRouteItem) Get(f ContextHandler) *ContextRouteItem {
+//一个 route 可以有多个 method, 每个 method 有自己的 handler
+//  r.Path("/article/{id}").Get(&ShowArticle{}).Put(&UpdateArticle{}).Delete(&DeleteArticle{})
+func (r *ContextRouteItem) handle(method string, f ContextHandler) *ContextRouteItem {
 	if r.err == nil {
-		r._methods("GET")
+		if method == "*" {
+			r._methods(anyMethods...)
+		} else {
+			r._methods(method)
+		}
 		//默认 controller 都是 http, 可以通过 OnlyScheme() 来改变
-		r.onlyscheme = "http"
-		r.action(f)
+		r.setDefaultHttp()
+		r.action(method, f)
 	}
 	return r
 }
 
+func (r *ContextRouteItem) Get(f ContextHandler) *ContextRouteItem {
+	return r.handle("GET", f)
+}
+
 func (r *ContextRouteItem) Post(f ContextHandler) *ContextRouteItem {
-	if r.err == nil {
-		r._methods("POST")
-		//默认 controller 都是 http, 可以通过 OnlyScheme() 来改变
-		r.onlyscheme = "http"
-		r.action(f)
-	}
-	return r
+	return r.handle("POST", f)
+}
+
+func (r *ContextRouteItem) Put(f ContextHandler) *ContextRouteItem {
+	return r.handle("PUT", f)
+}
+
+func (r *ContextRouteItem) Delete(f ContextHandler) *ContextRouteItem {
+	return r.handle("DELETE", f)
+}
+
+func (r *ContextRouteItem) Patch(f ContextHandler) *ContextRouteItem {
+	return r.handle("PATCH", f)
+}
+
+func (r *ContextRouteItem) Head(f ContextHandler) *ContextRouteItem {
+	return r.handle("HEAD", f)
+}
+
+func (r *ContextRouteItem) Options(f ContextHandler) *ContextRouteItem {
+	return r.handle("OPTIONS", f)
+}
+
+//Any 处理所有没有单独设置 handler 的 method
+func (r *ContextRouteItem) Any(f ContextHandler) *ContextRouteItem {
+	return r.handle("*", f)
 }
 
 ////===================== ContextHandler ====================
-type DatabusService func(*context.Context, Databus)
+
+// DatabusService fills the field of the bus it is registered for, see
+// Router.AddService. An error stops the request: it is responded with the
+// status of a middleware.HTTPError, else with a 500. A service may also write
+// the response itself, e.g. redirect to a login page, the handler then does
+// not run.
+type DatabusService func(*context.Context, Databus) error
 
 type ServeContextFunc func(*context.Context)
 
@@ -82,29 +170,48 @@ type ContextHandler interface {
 	ServeContext(context *context.Context)
 }
 
-type createCtxHandlerFunc func(map[string]DatabusService, *context.Context) http.Handler
+type createCtxHandlerFunc func(*context.Context) http.Handler
 
 type WrapperContextHandler struct {
 	context  *context.Context
-	bus      Databus
+	bus      *databus
 	handler  ContextHandler
-	services map[string]DatabusService
+	services map[interface{}]*busService
+	// Fields to resolve, dependencies first, see busPlan.
+	plan    []busStep
+	planErr error
+	run     *busRun
 }
 
-func (c *WrapperContextHandler) RunBus() {
-	for _, name := range c.bus.Fields() {
-		//fmt.Printf("RunBus, name=%s\n", name)
-		service, _ := c.services[name]
-		if service != nil {
-			service(c.context, c.bus)
-		} else {
-			fmt.Printf("RunBus, NOT find Service with name=%s\n", name)
-		}
+// RunBus runs the services of the fields of the handler, each after the
+// services it depends on. It stops at the first error, or when a service
+// wrote the response.
+func (c *WrapperContextHandler) RunBus() error {
+	if c.planErr != nil {
+		return c.planErr
+	}
+	if c.run == nil {
+		c.run = newBusRun(c.context, c.bus)
 	}
+	return c.run.resolve(c.services, c.plan)
 }
 
+// ServeHTTP runs the services then the handler. The handler does not run if
+// a service failed or wrote the response, see serviceFailed. The per-request
+// values are released when it returns.
 func (c *WrapperContextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//fmt.Printf("WrapperContextHandler.ServeHTTP\n")
-	c.RunBus()
+	//middleware 可能替换了 w 和 r
+	c.context.W, c.context.R = w, r
+	//service panic 时也要释放已创建的值
+	c.run = newBusRun(c.context, c.bus)
+	defer c.run.release()
+	if err := c.RunBus(); err != nil {
+		serviceFailed(c.context, err)
+		return
+	}
+	if c.context.Written() {
+		return
+	}
 	c.handler.ServeContext(c.context)
 }
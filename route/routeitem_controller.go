@@ -3,45 +3,71 @@ package route
 import (
 	//"fmt"
 	"github.com/smithfox/beego/context"
+	"github.com/smithfox/beego/middleware"
 	"net/http"
 	"reflect"
+	"strings"
 )
 
 type ControllerRouteItem struct {
 	HandlerRouteItem
 	createCtrlHandler NewControllerHandlerFunc
+	option            ControllerOption
+	// Controller type name, see Router.Walk.
+	handlerName string
+	// Databus plan of the controller, nil for ControllerFunc.
+	planner *busPlanner
 }
 
 func (r *ControllerRouteItem) Path(tpl string) *ControllerRouteItem {
-	r.err = r.addRegexpMatcher(tpl, false, false)
+	r.setError(r.addRegexpMatcher(tpl, false, false))
+	return r
+}
+
+// Name sets the name for the route, used to build URLs.
+func (r *ControllerRouteItem) Name(name string) *ControllerRouteItem {
+	r.setName(name, r)
+	return r
+}
+
+// Use adds middlewares wrapping the handler of the route.
+func (r *ControllerRouteItem) Use(mws ...Middleware) *ControllerRouteItem {
+	r.HandlerRouteItem.Use(mws...)
 	return r
 }
 
 func (r *ControllerRouteItem) CreateHandler(w http.ResponseWriter, req *http.Request) http.Handler {
-	routeParams := r.GetRouteParams(req)
+	routeParams := requestRouteParams(r, req)
 	context := &context.Context{W: w, R: req, Param: routeParams, EnableGzip: r.Router.EnableGzip}
 	//fmt.Printf("ControllerRouteItem\n")
 	return r.createCtrlHandler(context)
 }
 
+// ControllerFunc serves the requests with the controllers returned by f. The
+// type of the controllers is not known at registration, their databus fields
+// are not injected: use Controller for them.
 func (r *ControllerRouteItem) ControllerFunc(f func() Controller) *ControllerRouteItem {
 	if r.err == nil {
 		//默认 controller 都是 http, 可以通过 OnlyScheme() 来改变
-		r.onlyscheme = "http"
+		r.setDefaultHttp()
+		r.handlerName = "func() Controller"
 		r.createCtrlHandler = func(c *context.Context) ControllerHandler {
 			//fmt.Printf("RouteItem.createCtrlHandler\n")
 			ci := f()
 			ci.Init(c)
-			return &WrapperController{Controller: ci}
+			return &WrapperController{Controller: ci, routeitem: r}
 		}
 	}
 	return r
 }
 
+// Controller serves each request with a new controller of the type of c.
+// Its fields tagged bmgo, with the ones of its embedded structs, are filled
+// before Prepare as for the context handlers, see busTag.
 func (r *ControllerRouteItem) Controller(c Controller) *ControllerRouteItem {
 	if r.err == nil {
 		//默认 controller 都是 http, 可以通过 OnlyScheme() 来改变
-		r.onlyscheme = "http"
+		r.setDefaultHttp()
 		rt := reflect.TypeOf(c)
 		if rt.Kind() != reflect.Ptr {
 			panic("RoutItem.Controller parameter must pointer!")
@@ -49,18 +75,49 @@ func (r *ControllerRouteItem) Controller(c Controller) *ControllerRouteItem {
 
 		rt = rt.Elem()
 
+		bt := getBusType(rt)
+		if bt.err != nil {
+			r.setError(bt.err)
+			return r
+		}
+		r.planner = newBusPlanner(r.Router, bt)
+
+		r.handlerName = rt.String()
 		r.createCtrlHandler = func(ctx *context.Context) ControllerHandler {
 			vc := reflect.New(rt)
 			ci := vc.Interface().(Controller)
 			ci.Init(ctx)
-			return &WrapperController{Controller: ci}
+			wc := &WrapperController{Controller: ci, routeitem: r}
+			if len(bt.inject) > 0 || len(bt.bound) > 0 {
+				wc.bus = &databus{wv: vc.Elem(), bt: bt}
+				wc.services, wc.plan, wc.planErr = r.planner.plan()
+			}
+			return wc
 		}
 	}
 	return r
 }
 
+// busError returns the error of the databus plan of the controller, if any:
+// a missing service fails its requests.
+func (r *ControllerRouteItem) busError() error {
+	if r.planner == nil {
+		return nil
+	}
+	_, _, err := r.planner.plan()
+	return err
+}
+
+// Option overrides the auth and csrf checks of the route.
+func (r *ControllerRouteItem) Option(option ControllerOption) *ControllerRouteItem {
+	r.option = option
+	return r
+}
+
 ///===================== controller ========================
 
+//AuthAny: 不检查 auth, 即使路由设置了 CheckAuth()
+//CrsfAny: 不检查 csrf, 即使是 POST/PUT/DELETE
 type ControllerOption struct {
 	AuthAny bool
 	CrsfAny bool
@@ -94,35 +151,96 @@ type NewControllerHandlerFunc func(*context.Context) ControllerHandler
 
 type WrapperController struct {
 	Controller
+	routeitem *ControllerRouteItem
+	// Databus of the controller, nil if it has no field to fill.
+	bus      *databus
+	services map[interface{}]*busService
+	plan     []busStep
+	planErr  error
 }
 
 func (c *WrapperController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//fmt.Printf("WrapperController.ServeHTTP, method=%s\n", r.Method)
-	CallMatchedMethod(c.Controller)
+	//middleware 可能替换了 w 和 r
+	if ctx := c.Context(); ctx != nil {
+		ctx.W, ctx.R = w, r
+	}
+	//Prepare 之前注入, 同 WrapperContextHandler
+	if c.bus != nil {
+		ctx := c.Context()
+		if c.planErr != nil {
+			serviceFailed(ctx, c.planErr)
+			return
+		}
+		run := newBusRun(ctx, c.bus)
+		defer run.release()
+		if err := run.resolve(c.services, c.plan); err != nil {
+			serviceFailed(ctx, err)
+			return
+		}
+		if ctx.Written() {
+			return
+		}
+	}
+	if c.routeitem == nil {
+		CallMatchedMethod(c.Controller)
+		return
+	}
+	callMatchedMethod(c.Controller, c.routeitem.checkAuth, c.routeitem.checkCsrf, c.routeitem.option)
 }
 
+//CSRF 总是检查 POST/PUT/DELETE
 func CallMatchedMethod(c Controller) {
+	callMatchedMethod(c, false, false, ControllerOption{})
+}
+
+//checkAuth, checkCsrf 是路由的 CheckAuth(), CheckCsrf()
+//检查失败时, 通过 middleware 返回 401 或 403, 不再调用 Get/Post...
+func callMatchedMethod(c Controller, checkAuth, checkCsrf bool, option ControllerOption) {
 	//fmt.Printf("CallMatchedMethod\n")
-	r := c.Context().R
+	ctx := c.Context()
+	r := ctx.R
 
-	c.Init(c.Context())
+	c.Init(ctx)
 	c.Prepare()
+	defer c.Finish()
 
-	if r.Method == "GET" {
+	method := r.Method
+	if method == "POST" {
+		if m := r.Form.Get("_method"); m == "delete" || m == "put" {
+			method = strings.ToUpper(m)
+		}
+	}
+
+	if checkAuth && !option.AuthAny && !c.CheckAuth() {
+		middleware.Exception("401", ctx.W, r, "Unauthorized")
+		ctx.SetWritten()
+		return
+	}
+	if (checkCsrf || isUnsafeMethod(method)) && !option.CrsfAny && !c.CheckCsrf() {
+		middleware.Exception("403", ctx.W, r, "Forbidden")
+		ctx.SetWritten()
+		return
+	}
+
+	if method == "GET" {
 		c.Get()
-	} else if r.Method == "HEAD" {
+	} else if method == "HEAD" {
 		c.Head()
-	} else if r.Method == "DELETE" || (r.Method == "POST" && r.Form.Get("_method") == "delete") {
+	} else if method == "DELETE" {
 		c.Delete()
-	} else if r.Method == "PUT" || (r.Method == "POST" && r.Form.Get("_method") == "put") {
+	} else if method == "PUT" {
 		c.Put()
-	} else if r.Method == "POST" {
+	} else if method == "POST" {
 		c.Post()
-	} else if r.Method == "PATCH" {
+	} else if method == "PATCH" {
 		c.Patch()
-	} else if r.Method == "OPTIONS" {
+	} else if method == "OPTIONS" {
 		c.Options()
 	}
+}
 
-	c.Finish()
+//POST/PUT/PATCH/DELETE 总是检查 csrf
+func isUnsafeMethod(method string) bool {
+	return method == "POST" || method == "PUT" || method == "PATCH" || method == "DELETE"
 }
@@ -7,6 +7,7 @@ package route
 import (
 	"errors"
 	"fmt"
+	"github.com/smithfox/beego/context"
 	"net/http"
 	"net/url"
 	"strings"
@@ -20,6 +21,9 @@ type HandlerRouteItem struct {
 
 	// List of matchers.
 	matchers []matcher
+	// Accepted HTTP methods, any method if empty. Kept out of matchers so
+	// the router can tell a wrong method from a wrong path.
+	methods methodMatcher
 	// Manager for the variables from host and path.
 	regexp *routeRegexpGroup
 
@@ -35,20 +39,33 @@ type HandlerRouteItem struct {
 	name string
 	// Error resulted from building a route.
 	err error
+	// Error of a duplicated name, see Name.
+	nameErr error
 
 	// OnlyScheme=http,  https will force redirect to http
 	// OnlyScheme=https, http will force redirect to https
 	// otherwise, ignore
 	onlyscheme string
+	// The http scheme is the default of the context handlers and
+	// controllers, not set with OnlyScheme, see scheme.
+	defaultHttp bool
 
 	//POST/DEL/PUT auto forcely check csrf, the option means GET check
 	checkCsrf bool
 
 	checkAuth bool
+
+	// Middlewares wrapping the handler, see Use().
+	middlewares []Middleware
 }
 
 // Match matches the route against the request.
 func (r *HandlerRouteItem) Match(req *http.Request) bool {
+	return r.MatchPath(req) && r.MatchMethod(req.Method)
+}
+
+// MatchPath matches the route against the request, except for the method.
+func (r *HandlerRouteItem) MatchPath(req *http.Request) bool {
 	if r.buildOnly || r.err != nil {
 		return false
 	}
@@ -62,6 +79,19 @@ func (r *HandlerRouteItem) Match(req *http.Request) bool {
 	return true
 }
 
+// MatchMethod returns true if the route accepts the HTTP method.
+func (r *HandlerRouteItem) MatchMethod(method string) bool {
+	return len(r.methods) == 0 || matchInArray(r.methods, method)
+}
+
+// GetMethods returns the HTTP methods accepted by the route, nil means any.
+func (r *HandlerRouteItem) GetMethods() []string {
+	if len(r.methods) == 0 {
+		return nil
+	}
+	return append([]string{}, r.methods...)
+}
+
 // ----------------------------------------------------------------------------
 // HandlerRouteItem attributes
 // ----------------------------------------------------------------------------
@@ -71,25 +101,102 @@ func (r *HandlerRouteItem) GetError() error {
 	return r.err
 }
 
+// Name sets the name for the route, used to build URLs.
+// Names must be unique in a router: a duplicated name is not set, the route
+// still matches, it is reported by Validate and panics if StrictRoutes is
+// set.
+func (r *HandlerRouteItem) Name(name string) *HandlerRouteItem {
+	r.setName(name, r)
+	return r
+}
+
+// setName registers routeitem, the outermost route item type, by name.
+func (r *HandlerRouteItem) setName(name string, routeitem RouteItem) {
+	if r.err != nil {
+		return
+	}
+	if r.name != "" {
+		r.setNameError(fmt.Errorf("mux: route already has name %q, can't set %q", r.name, name))
+		return
+	}
+	var dup bool
+	err := r.Router.editTable(true, func(t *routeTable) error {
+		if _, ok := t.named[name]; ok {
+			dup = true
+			return fmt.Errorf("mux: route name %q already registered", name)
+		}
+		t.named[name] = routeitem
+		return nil
+	})
+	if dup {
+		r.setNameError(err)
+		return
+	}
+	if err != nil {
+		r.setError(err)
+		return
+	}
+	r.name = name
+}
+
+// setNameError keeps the error of a name which was not set, reported by
+// Validate. Unlike setError, the route still matches.
+func (r *HandlerRouteItem) setNameError(err error) {
+	if r.nameErr == nil {
+		r.nameErr = err
+	}
+	if r.Router.root().StrictRoutes {
+		panic(err)
+	}
+}
+
+// Use adds middlewares wrapping the handler of the route.
+func (r *HandlerRouteItem) Use(mws ...Middleware) *HandlerRouteItem {
+	r.middlewares = append(r.middlewares, mws...)
+	return r
+}
+
+func (r *HandlerRouteItem) routeMiddlewares() []Middleware {
+	return r.middlewares
+}
+
+// GetName returns the name for the route, if any.
+func (r *HandlerRouteItem) GetName() string {
+	return r.name
+}
+
+// setError keeps the error resulted from building the route, the route then
+// never matches. With Router.StrictRoutes it panics, so a mistyped route
+// fails at registration instead of turning into a 404.
+func (r *HandlerRouteItem) setError(err error) {
+	if err == nil || r.err != nil {
+		return
+	}
+	r.err = err
+	if r.Router.root().StrictRoutes {
+		panic(err)
+	}
+}
+
 // BuildOnly sets the route to never match: it is only used to build URLs.
 func (r *HandlerRouteItem) BuildOnly() *HandlerRouteItem {
 	r.buildOnly = true
 	return r
 }
 
+// GetSchemeRedirectURL returns the URL to redirect to if the scheme of the
+// request is not the one of the route. The scheme told by trusted proxies is
+// honoured, see context.SetTrustedProxies, and the ports follow the
+// SchemePolicy of the router.
 func (r *HandlerRouteItem) GetSchemeRedirectURL(req *http.Request) string {
-	var is_https_req bool = (req.TLS != nil)
-	if "https" == req.Header.Get("X-Scheme") {
-		is_https_req = true
-	}
+	var is_https_req bool = context.RequestScheme(req) == "https"
 
 	var redirectURL string = ""
-	if r.onlyscheme == "http" && is_https_req {
-		redirectURL = r.Router.httphost + req.RequestURI
-	} else if r.onlyscheme == "https" && !is_https_req && r.Router.enable_to_https {
-		redirectURL = r.Router.httpshost + req.RequestURI
-	} else {
-		redirectURL = ""
+	scheme := r.scheme()
+	if scheme == "http" && is_https_req {
+		redirectURL = r.Router.schemeRedirectURL(req, "http")
+	} else if scheme == "https" && !is_https_req && r.Router.enable_to_https {
+		redirectURL = r.Router.schemeRedirectURL(req, "https")
 	}
 	return redirectURL
 }
@@ -106,7 +213,11 @@ func (r *HandlerRouteItem) ExactMatchSlash() bool {
 //若模糊匹配URL的最后'/', 是否强制服从 route 的定义
 // route:  /url      request:  /url/   ==> redirect到  /url
 // route:  /url/     request:  /url    ==> redirect到  /url/
+// PathPrefix 不受影响, 其后的路径由 handler 处理
 func (r *HandlerRouteItem) RedirectSlash() bool {
+	if r.regexp != nil && r.regexp.path != nil && r.regexp.path.matchPrefix {
+		return false
+	}
 	return r.endSlashOption == RedictEndSlash
 }
 
@@ -149,7 +260,9 @@ func (r *HandlerRouteItem) addMatcher(m matcher) *HandlerRouteItem {
 
 func (r *HandlerRouteItem) GetRouteParams(req *http.Request) RouteParams {
 	routeParams := make(RouteParams)
-	r.regexp.setMatch(req, routeParams)
+	if r.regexp != nil {
+		r.regexp.setMatch(req, routeParams)
+	}
 	return routeParams
 }
 
@@ -176,7 +289,9 @@ func (r *HandlerRouteItem) addRegexpMatcher(tpl string, matchHost, matchPrefix b
 			return fmt.Errorf("mux: path must start with a slash, got %q", tpl)
 		}
 		if r.regexp.path != nil {
-			tpl = strings.TrimRight(r.regexp.path.template, "/") + tpl
+			tpl = joinPathTemplate(r.regexp.path.template, tpl)
+		} else {
+			tpl = joinPathTemplate(r.Router.prefix, tpl)
 		}
 	}
 	rr, err := newRouteRegexp(tpl, matchHost, matchPrefix, !r.ExactMatchSlash())
@@ -197,11 +312,32 @@ func (r *HandlerRouteItem) addRegexpMatcher(tpl string, matchHost, matchPrefix b
 			}
 		}
 		r.regexp.path = rr
+		r.Router.routesChanged()
 	}
 	r.addMatcher(rr)
 	return nil
 }
 
+// group returns the router or group the route was registered on.
+func (r *HandlerRouteItem) group() *Router {
+	return r.Router
+}
+
+// pathRegexp returns the path matcher used to index the route.
+func (r *HandlerRouteItem) pathRegexp() *routeRegexp {
+	if r.err != nil || r.regexp == nil {
+		return nil
+	}
+	return r.regexp.path
+}
+
+func (r *HandlerRouteItem) hostPattern() *routeRegexp {
+	if r.err != nil || r.regexp == nil {
+		return nil
+	}
+	return r.regexp.host
+}
+
 // Headers --------------------------------------------------------------------
 
 // headerMatcher matches the request against header values.
@@ -223,8 +359,8 @@ func (m headerMatcher) Match(r *http.Request) bool {
 // It the value is an empty string, it will match any value if the key is set.
 func (r *HandlerRouteItem) Headers(pairs ...string) *HandlerRouteItem {
 	if r.err == nil {
-		var headers map[string]string
-		headers, r.err = mapFromPairs(pairs...)
+		headers, err := mapFromPairs(pairs...)
+		r.setError(err)
 		return r.addMatcher(headerMatcher(headers))
 	}
 	return r
@@ -250,7 +386,7 @@ func (r *HandlerRouteItem) Headers(pairs ...string) *HandlerRouteItem {
 // Variable names must be unique in a given route. They can be retrieved
 // calling mux.Vars(request).
 func (r *HandlerRouteItem) Host(tpl string) *HandlerRouteItem {
-	r.err = r.addRegexpMatcher(tpl, true, false)
+	r.setError(r.addRegexpMatcher(tpl, true, false))
 	return r
 }
 
@@ -281,10 +417,15 @@ func (m methodMatcher) Match(r *http.Request) bool {
 // It accepts a sequence of one or more methods to be matched, e.g.:
 // "GET", "POST", "PUT".
 func (r *HandlerRouteItem) _methods(methods ...string) *HandlerRouteItem {
-	for k, v := range methods {
-		methods[k] = strings.ToUpper(v)
+	if r.err == nil {
+		for _, v := range methods {
+			v = strings.ToUpper(v)
+			if !matchInArray(r.methods, v) {
+				r.methods = append(r.methods, v)
+			}
+		}
 	}
-	return r.addMatcher(methodMatcher(methods))
+	return r
 }
 
 // Path -----------------------------------------------------------------------
@@ -308,7 +449,7 @@ func (r *HandlerRouteItem) _methods(methods ...string) *HandlerRouteItem {
 // Variable names must be unique in a given route. They can be retrieved
 // calling mux.Vars(request).
 func (r *HandlerRouteItem) Path(tpl string) *HandlerRouteItem {
-	r.err = r.addRegexpMatcher(tpl, false, false)
+	r.setError(r.addRegexpMatcher(tpl, false, false))
 	return r
 }
 
@@ -317,7 +458,7 @@ func (r *HandlerRouteItem) Path(tpl string) *HandlerRouteItem {
 // PathPrefix adds a matcher for the URL path prefix.
 func (r *HandlerRouteItem) PathPrefix(tpl string) *HandlerRouteItem {
 	r.endSlashOption = ExactEndSlash
-	r.err = r.addRegexpMatcher(tpl, false, true)
+	r.setError(r.addRegexpMatcher(tpl, false, true))
 	return r
 }
 
@@ -342,8 +483,8 @@ func (m queryMatcher) Match(r *http.Request) bool {
 // It the value is an empty string, it will match any value if the key is set.
 func (r *HandlerRouteItem) Queries(pairs ...string) *HandlerRouteItem {
 	if r.err == nil {
-		var queries map[string]string
-		queries, r.err = mapFromPairs(pairs...)
+		queries, err := mapFromPairs(pairs...)
+		r.setError(err)
 		return r.addMatcher(queryMatcher(queries))
 	}
 	return r
@@ -352,9 +493,28 @@ func (r *HandlerRouteItem) Queries(pairs ...string) *HandlerRouteItem {
 // Schemes --------------------------------------------------------------------
 func (r *HandlerRouteItem) OnlyScheme(scheme string) *HandlerRouteItem {
 	r.onlyscheme = strings.ToLower(scheme)
+	r.defaultHttp = false
 	return r
 }
 
+// setDefaultHttp serves the route on http if it has no scheme.
+func (r *HandlerRouteItem) setDefaultHttp() {
+	if r.onlyscheme == "" {
+		r.onlyscheme = "http"
+		r.defaultHttp = true
+	}
+}
+
+// scheme returns the scheme the route is served on, "" for both. The http
+// default is dropped when the router sends HSTS: the browsers would upgrade
+// the redirect to http back to https.
+func (r *HandlerRouteItem) scheme() string {
+	if r.defaultHttp && r.Router.root().schemePolicy.HSTSMaxAge > 0 {
+		return ""
+	}
+	return r.onlyscheme
+}
+
 func (r *HandlerRouteItem) CheckCsrf() *HandlerRouteItem {
 	r.checkCsrf = true
 	return r
@@ -380,7 +540,7 @@ func (r *HandlerRouteItem) CheckAuth() *HandlerRouteItem {
 //
 // ...a URL for it can be built using:
 //
-//     url, err := r.Get("article").URL("category", "technology", "id", "42")
+//     url, err := r.GetRoute("article").URL("category", "technology", "id", "42")
 //
 // ...which will return an url.URL with the following path:
 //
@@ -394,13 +554,26 @@ func (r *HandlerRouteItem) CheckAuth() *HandlerRouteItem {
 //       Name("article")
 //
 //     // url.String() will be "http://news.domain.com/articles/technology/42"
-//     url, err := r.Get("article").URL("subdomain", "news",
+//     url, err := r.GetRoute("article").URL("subdomain", "news",
 //                                      "category", "technology",
 //                                      "id", "42")
 //
 // All variables defined in the route are required, and their values must
-// conform to the corresponding patterns.
+// conform to the corresponding patterns. See URLValues for the values of
+// typed variables.
+//
+// The scheme follows OnlyScheme. A route without host template gets the
+// host of the router (httphost or httpshost) for its scheme, if any, so the
+// link does not need a scheme redirect.
 func (r *HandlerRouteItem) URL(pairs ...string) (*url.URL, error) {
+	return r.URLValues(stringPairs(pairs)...)
+}
+
+// URLValues is URL with values of any type. Values of typed variables, like
+// {id:int}, are formatted by their converter, the others with fmt.Sprint:
+//
+//     url, err := r.GetRoute("user").(*HandlerRouteItem).URLValues("id", 42)
+func (r *HandlerRouteItem) URLValues(pairs ...interface{}) (*url.URL, error) {
 	if r.err != nil {
 		return nil, r.err
 	}
@@ -412,9 +585,14 @@ func (r *HandlerRouteItem) URL(pairs ...string) (*url.URL, error) {
 	if r.regexp.host != nil {
 		// Set a default scheme.
 		scheme = "http"
+		if r.scheme() == "https" {
+			scheme = "https"
+		}
 		if host, err = r.regexp.host.url(pairs...); err != nil {
 			return nil, err
 		}
+	} else {
+		scheme, host = r.Router.schemeHost(r.scheme())
 	}
 	if r.regexp.path != nil {
 		if path, err = r.regexp.path.url(pairs...); err != nil {
@@ -432,6 +610,11 @@ func (r *HandlerRouteItem) URL(pairs ...string) (*url.URL, error) {
 //
 // The route must have a host defined.
 func (r *HandlerRouteItem) URLHost(pairs ...string) (*url.URL, error) {
+	return r.URLHostValues(stringPairs(pairs)...)
+}
+
+// URLHostValues is URLHost with values of any type, see URLValues.
+func (r *HandlerRouteItem) URLHostValues(pairs ...interface{}) (*url.URL, error) {
 	if r.err != nil {
 		return nil, r.err
 	}
@@ -442,8 +625,12 @@ func (r *HandlerRouteItem) URLHost(pairs ...string) (*url.URL, error) {
 	if err != nil {
 		return nil, err
 	}
+	scheme := "http"
+	if r.scheme() == "https" {
+		scheme = "https"
+	}
 	return &url.URL{
-		Scheme: "http",
+		Scheme: scheme,
 		Host:   host,
 	}, nil
 }
@@ -452,6 +639,11 @@ func (r *HandlerRouteItem) URLHost(pairs ...string) (*url.URL, error) {
 //
 // The route must have a path defined.
 func (r *HandlerRouteItem) URLPath(pairs ...string) (*url.URL, error) {
+	return r.URLPathValues(stringPairs(pairs)...)
+}
+
+// URLPathValues is URLPath with values of any type, see URLValues.
+func (r *HandlerRouteItem) URLPathValues(pairs ...interface{}) (*url.URL, error) {
 	if r.err != nil {
 		return nil, r.err
 	}
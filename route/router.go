@@ -2,12 +2,13 @@ package route
 
 import (
 	"fmt"
-	"github.com/smithfox/beego/recovery"
-	"log"
+	"github.com/smithfox/beego/context"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type FilterFunc func(http.ResponseWriter, *http.Request) bool
@@ -23,26 +24,62 @@ type Filter interface {
 type Router struct {
 	// Configurable Handler to be used when no route matches.
 	NotFoundHandler http.Handler
-	// Routes to be matched, in order.
-	routes          []RouteItem
-	filters         []Filter
+	// Panic when a route fails to build, instead of keeping the error in the
+	// route which then never matches. See also Validate().
+	StrictRoutes bool
+	// Configurable Handler to be used when routes match the path but not the
+	// method. The Allow header is already set when it is called.
+	MethodNotAllowedHandler http.Handler
+	// Published *routeTable of the root router, see Update.
+	table atomic.Value
+	// Table being built by Update, published when it returns.
+	pending    *routeTable
+	lock       sync.Mutex
+	updateLock sync.Mutex
+	frozen     bool
+
+	filters         [FinishRouter + 1][]Filter
+	middlewares     []Middleware
 	httphost        string
 	httpshost       string
 	enable_to_https bool //是否允许重定向到 https
 	EnableGzip      bool
-	services        map[string]DatabusService
+	// map[interface{}]*busService of the root router, copied on AddService.
+	services atomic.Value
+
+	// The router a group was created from, nil for the root router.
+	parent *Router
+	depth  int
+	// Defaults for the routes registered on a group.
+	prefix     string
+	host       string
+	onlyscheme string
+	checkCsrf  bool
+	checkAuth  bool
+	// Compiled prefix and host of a group.
+	prefixRegexp *routeRegexp
+	hostRegexp   *routeRegexp
+	groupErr     error
+	// Error of an invalid InsertFilter, see Validate.
+	filterErr error
+	// Redirects between schemes and HSTS, of the root router.
+	schemePolicy SchemePolicy
 }
 
 // NewRouter returns a new router instance.
+//
+// The scheme policy is the one of the beego configuration, see
+// ConfigSchemePolicy and SetSchemePolicy.
 func NewRouter(enable_gzip bool) *Router {
-	router := &Router{services: make(map[string]DatabusService)}
+	router := &Router{}
 	router.EnableGzip = enable_gzip
+	router.schemePolicy = ConfigSchemePolicy()
 	return router
 }
 
 // NewRouter returns a new router instance.
 func NewRouterWithHost(httphost, httpshost string, enable_to_https bool, enable_gzip bool) *Router {
-	router := &Router{services: make(map[string]DatabusService)}
+	router := &Router{}
 	router.EnableGzip = enable_gzip
 	router.httphost = httphost
 	router.httpshost = httpshost
@@ -50,6 +87,7 @@ func NewRouterWithHost(httphost, httpshost string, enable_to_https bool, enable_
 		enable_to_https = false
 	}
 	router.enable_to_https = enable_to_https
+	router.schemePolicy = ConfigSchemePolicy()
 	return router
 }
 
@@ -58,53 +96,146 @@ func NewRouterWithHost(httphost, httpshost string, enable_to_https bool, enable_
 // }
 
 func (r *Router) newHandlerRouteItem() *HandlerRouteItem {
-	routeitem := &HandlerRouteItem{Router: r}
-	r.routes = append(r.routes, routeitem)
+	routeitem := &HandlerRouteItem{}
+	r.initRouteItem(routeitem)
 	return routeitem
 }
 
 func (r *Router) newContextRouteItem() *ContextRouteItem {
 	routeitem := &ContextRouteItem{}
-	routeitem.Router = r
-	r.routes = append(r.routes, routeitem)
+	r.initRouteItem(&routeitem.HandlerRouteItem)
 	return routeitem
 }
 
 func (r *Router) newControllerRouteItem() *ControllerRouteItem {
 	routeitem := &ControllerRouteItem{}
-	routeitem.Router = r
-	r.routes = append(r.routes, routeitem)
+	r.initRouteItem(&routeitem.HandlerRouteItem)
+	return routeitem
+}
+
+// addRoute appends the route, once built, to the routes of the root router.
+// It panics with ErrFrozen if the router is frozen.
+func (r *Router) addRoute(routeitem RouteItem) {
+	err := r.editTable(true, func(t *routeTable) error {
+		t.routes = append(t.routes, routeitem)
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (r *Router) addHandlerRoute(routeitem *HandlerRouteItem) *HandlerRouteItem {
+	r.addRoute(routeitem)
+	return routeitem
+}
+
+func (r *Router) addContextRoute(routeitem *ContextRouteItem) *ContextRouteItem {
+	r.addRoute(routeitem)
+	return routeitem
+}
+
+func (r *Router) addControllerRoute(routeitem *ControllerRouteItem) *ControllerRouteItem {
+	r.addRoute(routeitem)
 	return routeitem
 }
 
 // Match matches registered routes against the request.
+// Only the routes whose static path prefix and host fit the request are
+// tested, in registration order, the first matching route wins, with or
+// without host template.
+//
+// A HEAD request matches a GET route if no route accepts HEAD.
 func (r *Router) Match(req *http.Request) RouteItem {
-	for _, route := range r.routes {
-		if route.Match(req) {
-			return route
+	routeitem, _ := r.matchRoute(req)
+	return routeitem
+}
+
+// matchRoute returns the route matching the request. If there is none,
+// allow lists the methods accepted by the routes matching the path, nil if
+// the path matches no route.
+func (r *Router) matchRoute(req *http.Request) (RouteItem, []string) {
+	t := r.loadTable()
+	var buf [16]int
+	var allow []string
+	var head RouteItem
+	idx := t.getIndex()
+	host := ""
+	if idx.hasHosts() {
+		host = getHost(req)
+	}
+	for _, pos := range idx.lookup(host, req.URL.Path, buf[:]) {
+		routeitem := t.routes[pos]
+		if !routeitem.MatchPath(req) {
+			continue
+		}
+		if routeitem.MatchMethod(req.Method) {
+			return routeitem, nil
+		}
+		if head == nil && req.Method == "HEAD" && routeitem.MatchMethod("GET") {
+			head = routeitem
+		}
+		for _, m := range routeitem.GetMethods() {
+			if !matchInArray(allow, m) {
+				allow = append(allow, m)
+			}
 		}
 	}
-	return nil
+	if head != nil {
+		return head, nil
+	}
+	if allow != nil {
+		if matchInArray(allow, "GET") && !matchInArray(allow, "HEAD") {
+			allow = append(allow, "HEAD")
+		}
+		if !matchInArray(allow, "OPTIONS") {
+			allow = append(allow, "OPTIONS")
+		}
+	}
+	return nil, allow
 }
 
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.parent != nil {
+		r.root().ServeHTTP(w, req)
+		return
+	}
+	tw := &responseTracker{ResponseWriter: w}
+	w = tw
+	// Values set by the filters reach the handler, see context.SetValue.
+	req = context.WithValues(req)
 	defer func() {
 		if err := recover(); err != nil {
-			stack := recovery.Stack(0)
-			log.Printf("Router ServeHTTP PANIC: %s\n%s\n", err, stack)
+			recoverPanic(err, tw, req)
 		}
 	}()
 
+	r.schemePolicy.setHSTS(w, req)
+
 	//debug.PrintStack()
 	//fmt.Printf("router ServeHTTP, url=%q\n", req.URL)
-	for _, filter := range r.filters {
+	//BeforeRouter filter 停止请求时也运行 FinishRouter filters
+	chain := []*Router{r}
+	defer func() {
+		runFilters(chain, FinishRouter, w, req)
+	}()
+	for _, filter := range r.filters[BeforeRouter] {
 		if ok := filter.FilterHTTP(w, req); !ok {
 			return
 		}
 	}
 
+	if req.Method == "HEAD" {
+		w = &headResponseWriter{ResponseWriter: w}
+	}
+
 	var handler http.Handler
-	routeitem := r.Match(req)
+	routeitem, allow := r.matchRoute(req)
+	if routeitem != nil {
+		req = withRouteMatch(req, routeitem)
+		chain = r.routerChain(routeitem)
+	}
+
 	if routeitem != nil {
 		//fmt.Printf("router.ServHTTP, matched for url=%v\n", req.URL)
 		//{{处理 https和 http 的redirect
@@ -112,7 +243,11 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 		if redirectURL != "" {
 			//fmt.Printf("Router ServeHTTP redirectURL=%s\n", redirectURL)
-			http.Redirect(w, req, redirectURL, http.StatusSeeOther)
+			if strings.HasPrefix(redirectURL, "http:") {
+				//HSTS 会让浏览器再升级到 https, 循环重定向
+				w.Header().Del("Strict-Transport-Security")
+			}
+			http.Redirect(w, req, redirectURL, r.schemePolicy.redirectStatus())
 			return
 		}
 		//}}
@@ -139,17 +274,84 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		}
 		//}}
 
+		if ok := runFilters(chain, BeforeExec, w, req); !ok {
+			return
+		}
+
 		handler = routeitem.CreateHandler(w, req)
 	}
 
-	if handler == nil {
-		if r.NotFoundHandler == nil {
-			r.NotFoundHandler = http.NotFoundHandler()
+	if routeitem == nil && allow != nil {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		if req.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+		} else if r.MethodNotAllowedHandler != nil {
+			r.MethodNotAllowedHandler.ServeHTTP(w, req)
+		} else {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		}
-		handler = r.NotFoundHandler
+		return
 	}
 
-	handler.ServeHTTP(w, req)
+	if handler == nil {
+		r.notFoundHandler(req).ServeHTTP(w, req)
+		return
+	}
+
+	wrapMiddlewares(chain, routeitem, handler).ServeHTTP(w, req)
+	runFilters(chain, AfterExec, w, req)
+}
+
+// headResponseWriter discards the body written by a GET handler serving a
+// HEAD request.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// GetRoute returns the route registered with the given name, or nil.
+func (r *Router) GetRoute(name string) RouteItem {
+	return r.loadTable().named[name]
+}
+
+// URLFor builds a URL for the named route, see HandlerRouteItem.URL().
+func (r *Router) URLFor(name string, pairs ...string) (*url.URL, error) {
+	return r.URLForValues(name, stringPairs(pairs)...)
+}
+
+// URLForValues builds a URL for the named route with values of any type, see
+// HandlerRouteItem.URLValues().
+func (r *Router) URLForValues(name string, pairs ...interface{}) (*url.URL, error) {
+	route, ok := r.GetRoute(name).(interface {
+		URLValues(pairs ...interface{}) (*url.URL, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("mux: no route named %q", name)
+	}
+	return route.URLValues(pairs...)
+}
+
+// schemeHost returns the scheme and host configured for links which must use
+// the given scheme, empty if the router has no host for it.
+// httphost and httpshost are like "http://www.domain.com".
+func (r *Router) schemeHost(scheme string) (string, string) {
+	var base string
+	if scheme == "http" {
+		base = r.httphost
+	} else if scheme == "https" {
+		base = r.httpshost
+	}
+	if base == "" {
+		return "", ""
+	}
+	host := strings.TrimRight(base, "/")
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		scheme, host = u.Scheme, u.Host
+	}
+	return scheme, hostWithPort(host, r.root().schemePolicy.port(scheme), scheme)
 }
 
 /*
@@ -157,40 +359,63 @@ func (r *Router) MapDatabus(name string, f DatabusFunc) {
 	r.databuses[name] = f
 }
 */
-func (r *Router) AddService(name string, s DatabusService) {
-	r.services[name] = s
-}
 
 func (r *Router) Get(path string, v ContextHandler) *ContextRouteItem {
-	return r.newContextRouteItem().Path(path).Get(v)
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Get(v))
 }
 
 func (r *Router) Post(path string, v ContextHandler) *ContextRouteItem {
-	return r.newContextRouteItem().Path(path).Post(v)
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Post(v))
+}
+
+func (r *Router) Put(path string, v ContextHandler) *ContextRouteItem {
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Put(v))
+}
+
+func (r *Router) Delete(path string, v ContextHandler) *ContextRouteItem {
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Delete(v))
+}
+
+func (r *Router) Patch(path string, v ContextHandler) *ContextRouteItem {
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Patch(v))
+}
+
+func (r *Router) Head(path string, v ContextHandler) *ContextRouteItem {
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Head(v))
+}
+
+func (r *Router) Options(path string, v ContextHandler) *ContextRouteItem {
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Options(v))
+}
+
+func (r *Router) Any(path string, v ContextHandler) *ContextRouteItem {
+	return r.addContextRoute(r.newContextRouteItem().Path(path).Any(v))
 }
 
 func (r *Router) ControllerFunc(path string, f func() Controller) *ControllerRouteItem {
-	return r.newControllerRouteItem().Path(path).ControllerFunc(f)
+	return r.addControllerRoute(r.newControllerRouteItem().Path(path).ControllerFunc(f))
 }
 
 func (r *Router) Controller(path string, c Controller) *ControllerRouteItem {
-	return r.newControllerRouteItem().Path(path).Controller(c)
+	return r.addControllerRoute(r.newControllerRouteItem().Path(path).Controller(c))
 }
 
 // Handle registers a new route with a matcher for the URL path.
 func (r *Router) Handle(path string, handler http.Handler) *HandlerRouteItem {
-	return r.newHandlerRouteItem().Path(path).Handler(handler)
+	return r.addHandlerRoute(r.newHandlerRouteItem().Path(path).Handler(handler))
 }
 
 // HandleFunc registers a new route with a matcher for the URL path.
 // See Route.Path() and Route.HandlerFunc().
 func (r *Router) HandleFunc(path string, f func(http.ResponseWriter,
 	*http.Request)) *HandlerRouteItem {
-	return r.newHandlerRouteItem().Path(path).HandlerFunc(f)
+	return r.addHandlerRoute(r.newHandlerRouteItem().Path(path).HandlerFunc(f))
 }
 
+// Filter adds a filter run before the routes are matched.
+// The filters of a group run after one of the routes of the group matched.
 func (r *Router) Filter(filter Filter) {
-	r.filters = append(r.filters, filter)
+	r.InsertFilter(BeforeRouter, filter)
 }
 
 func (r *Router) FilterFunc(f func(http.ResponseWriter,
@@ -246,6 +471,34 @@ func mapFromPairs(pairs ...string) (map[string]string, error) {
 	return m, nil
 }
 
+// stringPairs converts variadic string parameters for mapFromValuePairs.
+func stringPairs(pairs []string) []interface{} {
+	values := make([]interface{}, len(pairs))
+	for i, v := range pairs {
+		values[i] = v
+	}
+	return values
+}
+
+// mapFromValuePairs converts variadic key/value parameters to a map, keys
+// must be strings.
+func mapFromValuePairs(pairs ...interface{}) (map[string]interface{}, error) {
+	length := len(pairs)
+	if length%2 != 0 {
+		return nil, fmt.Errorf(
+			"mux: number of parameters must be multiple of 2, got %v", pairs)
+	}
+	m := make(map[string]interface{}, length/2)
+	for i := 0; i < length; i += 2 {
+		key, ok := pairs[i].(string)
+		if !ok {
+			return nil, fmt.Errorf("mux: parameter name must be a string, got %v", pairs[i])
+		}
+		m[key] = pairs[i+1]
+	}
+	return m, nil
+}
+
 // matchInArray returns true if the given string value is in the array.
 func matchInArray(arr []string, value string) bool {
 	for _, v := range arr {
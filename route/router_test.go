@@ -0,0 +1,1284 @@
+package route
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"fmt"
+	"github.com/smithfox/beego"
+	"github.com/smithfox/beego/context"
+	"github.com/smithfox/beego/middleware"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newRequest(method, url string) *http.Request {
+	req, _ := http.NewRequest(method, url, nil)
+	return req
+}
+
+func nopHandler(w http.ResponseWriter, r *http.Request) {}
+
+// matchScan is the linear scan Router.Match used before the route index.
+func matchScan(r *Router, req *http.Request) RouteItem {
+	for _, route := range r.loadTable().routes {
+		if route.Match(req) {
+			return route
+		}
+	}
+	return nil
+}
+
+func Test_MatchIndex(t *testing.T) {
+	r := NewRouter(false)
+	routes := []RouteItem{
+		r.HandleFunc("/", nopHandler),
+		r.HandleFunc("/articles/", nopHandler),
+		r.HandleFunc("/articles/{category}/{id:[0-9]+}", nopHandler),
+		r.HandleFunc("/articles/{category}/new", nopHandler),
+		r.addHandlerRoute(r.newHandlerRouteItem().PathPrefix("/static/").HandlerFunc(nopHandler)),
+		r.HandleFunc("/static/favicon.ico", nopHandler),
+		r.HandleFunc("/art", nopHandler),
+	}
+	exact := r.newHandlerRouteItem()
+	exact.SetSlashOption(ExactEndSlash)
+	r.addHandlerRoute(exact.Path("/exact").HandlerFunc(nopHandler))
+	routes = append(routes, exact)
+
+	tests := []struct {
+		path  string
+		route RouteItem
+	}{
+		{"/", routes[0]},
+		{"/articles", routes[1]},
+		{"/articles/", routes[1]},
+		{"/articles/go/42", routes[2]},
+		{"/articles/go/new", routes[3]},
+		{"/articles/go/42/", routes[2]},
+		{"/static/css/a.css", routes[4]},
+		{"/static/favicon.ico", routes[4]},
+		{"/art", routes[6]},
+		{"/art/", routes[6]},
+		{"/arts", nil},
+		{"/exact", routes[7]},
+		{"/exact/", nil},
+		{"/nothing", nil},
+	}
+	for _, test := range tests {
+		req := newRequest("GET", "http://localhost"+test.path)
+		if got := r.Match(req); got != test.route {
+			t.Errorf("Match(%q) = %v, want %v", test.path, got, test.route)
+		}
+		if got := matchScan(r, req); got != test.route {
+			t.Errorf("matchScan(%q) = %v, want %v", test.path, got, test.route)
+		}
+	}
+}
+
+func Test_MatchIndexAfterRegistration(t *testing.T) {
+	r := NewRouter(false)
+	r.HandleFunc("/a", nopHandler)
+	req := newRequest("GET", "http://localhost/b")
+	if r.Match(req) != nil {
+		t.Errorf("/b should not match")
+	}
+	b := r.HandleFunc("/b", nopHandler)
+	if r.Match(req) != b {
+		t.Errorf("/b should match after registration")
+	}
+}
+
+func Test_MatchIndexHost(t *testing.T) {
+	r := NewRouter(false)
+	host := r.addHandlerRoute(r.newHandlerRouteItem().Host("{sub}.example.com").HandlerFunc(nopHandler))
+	path := r.HandleFunc("/x", nopHandler)
+
+	req := newRequest("GET", "http://www.example.com/x")
+	if r.Match(req) != host {
+		t.Errorf("host route registered first must win")
+	}
+	req = newRequest("GET", "http://www.other.com/x")
+	if r.Match(req) != path {
+		t.Errorf("path route must match other hosts")
+	}
+}
+
+func Test_ServeHTTPRedirectSlash(t *testing.T) {
+	r := NewRouter(false)
+	r.HandleFunc("/dir/", nopHandler).SetSlashOption(RedictEndSlash)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("POST", "http://localhost/dir"))
+	expect(t, w.Code, http.StatusTemporaryRedirect)
+	expect(t, w.Header().Get("Location"), "http://localhost/dir/")
+}
+
+type testController struct {
+	beego.Controller
+}
+
+func Test_URLFor(t *testing.T) {
+	r := NewRouterWithHost("http://www.example.com", "https://secure.example.com", true, false)
+	r.SetSchemePolicy(SchemePolicy{})
+	r.HandleFunc("/articles/{category}/{id:[0-9]+}", nopHandler).Name("article")
+	r.HandleFunc("/login", nopHandler).OnlyScheme("https").Name("login")
+	r.addHandlerRoute(r.newHandlerRouteItem().Host("{sub}.example.com").Path("/feed")).Name("feed")
+	r.Controller("/ctrl/{id}", &testController{}).Name("ctrl")
+
+	tests := []struct {
+		name  string
+		pairs []string
+		url   string
+	}{
+		{"article", []string{"category", "go", "id", "42"}, "/articles/go/42"},
+		{"login", nil, "https://secure.example.com/login"},
+		{"feed", []string{"sub", "news"}, "http://news.example.com/feed"},
+		{"ctrl", []string{"id", "7"}, "http://www.example.com/ctrl/7"},
+	}
+	for _, test := range tests {
+		u, err := r.URLFor(test.name, test.pairs...)
+		if err != nil {
+			t.Errorf("URLFor(%q): %v", test.name, err)
+			continue
+		}
+		expect(t, u.String(), test.url)
+	}
+
+	if _, err := r.URLFor("article", "category", "go", "id", "x"); err == nil {
+		t.Errorf("URLFor with a bad variable must fail")
+	}
+	if _, err := r.URLFor("nothing"); err == nil {
+		t.Errorf("URLFor with an unknown name must fail")
+	}
+	if u, err := r.URLForValues("ctrl", "id", 7); err != nil || u.String() != "http://www.example.com/ctrl/7" {
+		t.Errorf("URLForValues(\"ctrl\") = %v, %v", u, err)
+	}
+	if _, err := r.URLForValues("nothing"); err == nil {
+		t.Errorf("URLForValues with an unknown name must fail")
+	}
+	if _, ok := r.GetRoute("ctrl").(*ControllerRouteItem); !ok {
+		t.Errorf("GetRoute must return the registered route item")
+	}
+}
+
+func Test_DuplicateName(t *testing.T) {
+	r := NewRouter(false)
+	first := r.HandleFunc("/a", nopHandler).Name("a")
+	second := r.HandleFunc("/b", nopHandler).Name("a")
+	if r.GetRoute("a") != first {
+		t.Errorf("duplicated route name must not replace the first route")
+	}
+	// The name is rejected, not the route.
+	expect(t, second.GetError(), nil)
+	expect(t, second.GetName(), "")
+	if r.Match(newRequest("GET", "http://localhost/b")) != second {
+		t.Errorf("a route with a duplicated name must still match")
+	}
+	if err := r.Validate(); err == nil || !strings.Contains(err.Error(), `route name "a" already registered`) {
+		t.Errorf("Validate must report the duplicated route name, got %v", err)
+	}
+
+	r.StrictRoutes = true
+	defer func() {
+		if recover() == nil {
+			t.Errorf("StrictRoutes must panic on a duplicated route name")
+		}
+	}()
+	r.Get("/c", &testParamHandler{}).Name("a")
+}
+
+type testParamHandler struct{}
+
+func (h *testParamHandler) ServeContext(ctx *context.Context) {
+	id, err := ctx.ParamInt("id")
+	if err != nil {
+		ctx.SetStatus(http.StatusBadRequest)
+		return
+	}
+	uuid, _ := ctx.ParamUUID("uuid")
+	ctx.WriteString(fmt.Sprintf("%d %s %s", id, uuid, ctx.GetURLRouterParam("rest")))
+}
+
+func Test_TypedParams(t *testing.T) {
+	RegisterConverter("hex", RegexpConverter("[0-9a-f]+"))
+	r := NewRouter(false)
+	r.Get("/user/{id:int}/{uuid:uuid}/{rest:path}", &testParamHandler{}).Name("files")
+	slug := r.HandleFunc("/post/{slug:slug}/{color:hex}", nopHandler).Name("post")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/user/42/0E8F7A1C-1111-2222-3333-444455556666/a/b/c.txt"))
+	expect(t, w.Body.String(), "42 0e8f7a1c-1111-2222-3333-444455556666 a/b/c.txt")
+
+	if r.Match(newRequest("GET", "http://localhost/user/x/0e8f7a1c-1111-2222-3333-444455556666/a")) != nil {
+		t.Errorf("{id:int} must not match a word")
+	}
+	if r.Match(newRequest("GET", "http://localhost/post/hello-world_1/ff00")) != slug {
+		t.Errorf("{slug:slug} and a registered converter must match")
+	}
+	if r.Match(newRequest("GET", "http://localhost/post/hello.world/ff00")) != nil {
+		t.Errorf("{slug:slug} must not match a dot")
+	}
+
+	u, err := r.URLForValues("files", "id", int64(42), "uuid", "0e8f7a1c-1111-2222-3333-444455556666", "rest", "a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, u.String(), "/user/42/0e8f7a1c-1111-2222-3333-444455556666/a/b.txt")
+	if _, err := r.URLForValues("files", "id", 4.2, "uuid", "0e8f7a1c-1111-2222-3333-444455556666", "rest", ""); err == nil {
+		t.Errorf("{id:int} must not format a float")
+	}
+	if _, err := r.URLForValues("files", "id", 1, "uuid", "nope", "rest", ""); err == nil {
+		t.Errorf("{uuid:uuid} must check the value")
+	}
+}
+
+func Test_RegisterConverterConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterConverter(fmt.Sprintf("conc%d", i), RegexpConverter("[a-z]+"))
+		}(i)
+		go func() {
+			defer wg.Done()
+			NewRouter(false).HandleFunc("/n/{id:int}", nopHandler)
+		}()
+	}
+	wg.Wait()
+}
+
+func Test_Group(t *testing.T) {
+	r := NewRouterWithHost("http://www.example.com", "https://www.example.com:4043", true, false)
+	api := r.Group("/api/")
+	v1 := api.Group("/v1").OnlyScheme("https").CheckAuth()
+	users := v1.HandleFunc("/users/{id}", nopHandler).Name("user")
+	admin := r.Host("admin.example.com").Group("/admin")
+	dash := admin.HandleFunc("/dash", nopHandler)
+
+	req := newRequest("GET", "http://www.example.com/api/v1/users/42")
+	if r.Match(req) != users {
+		t.Errorf("group route must match the prefixed path")
+	}
+	expect(t, users.GetRouteParams(req)["id"], "42")
+	expect(t, users.onlyscheme, "https")
+	expect(t, users.checkAuth, true)
+	u, err := r.URLFor("user", "id", "42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, u.String(), "https://www.example.com:4043/api/v1/users/42")
+
+	if r.Match(newRequest("GET", "http://admin.example.com/admin/dash")) != dash {
+		t.Errorf("host group route must match its host")
+	}
+	if r.Match(newRequest("GET", "http://www.example.com/admin/dash")) != nil {
+		t.Errorf("host group route must not match another host")
+	}
+}
+
+func Test_GroupFiltersAndNotFound(t *testing.T) {
+	r := NewRouter(false)
+	calls := []string{}
+	r.FilterFunc(func(w http.ResponseWriter, req *http.Request) bool {
+		calls = append(calls, "root")
+		return true
+	})
+	api := r.Group("/api")
+	api.FilterFunc(func(w http.ResponseWriter, req *http.Request) bool {
+		calls = append(calls, "api")
+		return true
+	})
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	v1 := api.Group("/v1")
+	v1.FilterFunc(func(w http.ResponseWriter, req *http.Request) bool {
+		calls = append(calls, "v1")
+		return req.URL.Query().Get("deny") == ""
+	})
+	v1.HandleFunc("/ping", func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, "handler")
+	})
+	r.HandleFunc("/other", nopHandler)
+
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/api/v1/ping"))
+	expect(t, fmt.Sprint(calls), "[root api v1 handler]")
+
+	calls = calls[:0]
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/other"))
+	expect(t, fmt.Sprint(calls), "[root]")
+
+	calls = calls[:0]
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/api/v1/ping?deny=1"))
+	expect(t, fmt.Sprint(calls), "[root api v1]")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/api/v1/nothing"))
+	expect(t, w.Code, http.StatusTeapot)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/nothing"))
+	expect(t, w.Code, http.StatusNotFound)
+	// The prefix matches whole segments.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/api"))
+	expect(t, w.Code, http.StatusTeapot)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/apiary"))
+	expect(t, w.Code, http.StatusNotFound)
+}
+
+func Test_GroupInvalidPrefix(t *testing.T) {
+	r := NewRouter(false)
+	bad := r.Group("api")
+	refute(t, bad.groupErr, nil)
+	refute(t, bad.HandleFunc("/ping", nopHandler).GetError(), nil)
+	refute(t, bad.Group("/v1").HandleFunc("/ping", nopHandler).GetError(), nil)
+	refute(t, r.Group("/api").Group("v1").HandleFunc("/ping", nopHandler).GetError(), nil)
+	if r.Match(newRequest("GET", "http://localhost/api/ping")) != nil {
+		t.Errorf("the routes of an invalid group must not match")
+	}
+	refute(t, r.Validate(), nil)
+
+	r.StrictRoutes = true
+	defer func() {
+		if recover() == nil {
+			t.Errorf("StrictRoutes must panic on an invalid group prefix")
+		}
+	}()
+	r.Group("api")
+}
+
+func Test_Middleware(t *testing.T) {
+	r := NewRouter(false)
+	calls := []string{}
+	mw := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				calls = append(calls, name+":"+CurrentParams(req)["id"])
+				next.ServeHTTP(w, req)
+			})
+		}
+	}
+	filter := func(name string) func(http.ResponseWriter, *http.Request) bool {
+		return func(w http.ResponseWriter, req *http.Request) bool {
+			calls = append(calls, name)
+			return true
+		}
+	}
+	r.Use(mw("root"))
+	r.InsertFilterFunc(BeforeExec, filter("beforeexec"))
+	r.InsertFilterFunc(AfterExec, filter("afterexec"))
+	r.InsertFilterFunc(FinishRouter, filter("finish"))
+	g := r.Group("/g").Use(mw("group"))
+	item := g.HandleFunc("/{id}", func(w http.ResponseWriter, req *http.Request) {
+		calls = append(calls, "handler")
+	}).Use(mw("route"))
+	item.Name("item")
+	r.InsertFilterFunc(BeforeExec, func(w http.ResponseWriter, req *http.Request) bool {
+		if CurrentRoute(req) != r.GetRoute("item") {
+			t.Errorf("BeforeExec filter must see the matched route")
+		}
+		return true
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/g/7"))
+	expect(t, fmt.Sprint(calls), "[beforeexec root:7 group:7 route:7 handler afterexec finish]")
+
+	calls = calls[:0]
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/nothing"))
+	expect(t, fmt.Sprint(calls), "[finish]")
+
+	// FinishRouter filters also run when a BeforeRouter filter stops.
+	r.InsertFilterFunc(BeforeRouter, func(w http.ResponseWriter, req *http.Request) bool {
+		calls = append(calls, "stop")
+		return false
+	})
+	calls = calls[:0]
+	r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "http://localhost/g/7"))
+	expect(t, fmt.Sprint(calls), "[stop finish]")
+
+	expect(t, r.Validate(), nil)
+	r.InsertFilterFunc(FinishRouter+1, filter("invalid"))
+	g.InsertFilterFunc(-1, filter("invalid"))
+	if errs, ok := r.Validate().(RouteErrors); !ok || len(errs) != 2 {
+		t.Errorf("invalid filter positions must be reported, got %v", r.Validate())
+	}
+	r.StrictRoutes = true
+	defer func() {
+		if recover() == nil {
+			t.Errorf("StrictRoutes must panic on an invalid filter position")
+		}
+	}()
+	r.InsertFilterFunc(-1, filter("invalid"))
+}
+
+// bodyRecorder keeps the body written by the handler.
+type bodyRecorder struct {
+	http.ResponseWriter
+	body []byte
+}
+
+func (w *bodyRecorder) Write(p []byte) (int, error) {
+	w.body = append(w.body, p...)
+	return len(p), nil
+}
+
+type requestController struct {
+	beego.Controller
+}
+
+func (c *requestController) Get() {
+	c.Ctx.WriteString(c.Ctx.R.Header.Get("X-Replaced"))
+}
+
+func Test_WrappingMiddleware(t *testing.T) {
+	r := NewRouter(false)
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			bw := &bodyRecorder{ResponseWriter: w}
+			req = req.WithContext(req.Context())
+			req.Header = req.Header.Clone()
+			req.Header.Set("X-Replaced", "yes")
+			next.ServeHTTP(bw, req)
+			w.Write([]byte("wrapped:"))
+			w.Write(bw.body)
+		})
+	})
+	r.Get("/ctx", &testCtxHandler{})
+	r.Controller("/ctrl", &requestController{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/ctx"))
+	expect(t, w.Body.String(), "wrapped:ok")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/ctrl"))
+	expect(t, w.Body.String(), "wrapped:yes")
+}
+
+type testCtxHandler struct{}
+
+func (h *testCtxHandler) ServeContext(ctx *context.Context) {
+	ctx.WriteString("ok")
+}
+
+type testPutHandler struct{}
+
+func (h *testPutHandler) ServeContext(ctx *context.Context) {
+	ctx.WriteString("put")
+}
+
+type testAnyHandler struct{}
+
+func (h *testAnyHandler) ServeContext(ctx *context.Context) {
+	ctx.WriteString("any")
+}
+
+func Test_ContextRouteMethods(t *testing.T) {
+	r := NewRouter(false)
+	r.Get("/item", &testCtxHandler{}).Put(&testPutHandler{})
+	r.Delete("/del", &testPutHandler{})
+	r.Any("/any", &testAnyHandler{}).Get(&testCtxHandler{})
+
+	tests := []struct {
+		method, path string
+		code         int
+		body         string
+	}{
+		{"GET", "/item", http.StatusOK, "ok"},
+		{"PUT", "/item", http.StatusOK, "put"},
+		{"POST", "/item", http.StatusMethodNotAllowed, "Method Not Allowed\n"},
+		{"DELETE", "/del", http.StatusOK, "put"},
+		{"GET", "/any", http.StatusOK, "ok"},
+		{"PATCH", "/any", http.StatusOK, "any"},
+		{"HEAD", "/any", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newRequest(test.method, "http://localhost"+test.path))
+		if w.Code != test.code || w.Body.String() != test.body {
+			t.Errorf("%s %s: got %d %q, want %d %q", test.method, test.path, w.Code, w.Body.String(), test.code, test.body)
+		}
+	}
+}
+
+func Test_MethodNotAllowed(t *testing.T) {
+	r := NewRouter(false)
+	r.Get("/item", &testCtxHandler{})
+	r.Post("/item", &testCtxHandler{})
+	r.HandleFunc("/any", nopHandler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("DELETE", "http://localhost/item"))
+	expect(t, w.Code, http.StatusMethodNotAllowed)
+	expect(t, w.Header().Get("Allow"), "GET, POST, HEAD, OPTIONS")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("OPTIONS", "http://localhost/item"))
+	expect(t, w.Code, http.StatusNoContent)
+	expect(t, w.Header().Get("Allow"), "GET, POST, HEAD, OPTIONS")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("HEAD", "http://localhost/item"))
+	expect(t, w.Code, http.StatusOK)
+	expect(t, w.Header().Get("Content-Length"), "2")
+	expect(t, w.Body.Len(), 0)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("DELETE", "http://localhost/nothing"))
+	expect(t, w.Code, http.StatusNotFound)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("DELETE", "http://localhost/any"))
+	expect(t, w.Code, http.StatusOK)
+}
+
+type checkController struct {
+	beego.Controller
+}
+
+func (c *checkController) CheckAuth() bool {
+	return c.Ctx.GetHeader("X-Auth") != ""
+}
+
+func (c *checkController) CheckCsrf() bool {
+	return c.Ctx.GetHeader("X-Csrf") != ""
+}
+
+func (c *checkController) Get() {
+	c.Ctx.WriteString("get")
+}
+
+func (c *checkController) Post() {
+	c.Ctx.WriteString("post")
+}
+
+func (c *checkController) Patch() {
+	c.Ctx.WriteString("patch")
+}
+
+func Test_ControllerChecks(t *testing.T) {
+	r := NewRouter(false)
+	r.Controller("/open", &checkController{})
+	r.Controller("/auth", &checkController{}).CheckAuth()
+	r.Controller("/csrf", &checkController{}).CheckCsrf()
+	r.Controller("/any", &checkController{}).Option(ControllerOption{AuthAny: true, CrsfAny: true}).CheckAuth()
+
+	tests := []struct {
+		method, path string
+		headers      []string
+		code         int
+	}{
+		{"GET", "/open", nil, http.StatusOK},
+		{"POST", "/open", nil, http.StatusForbidden},
+		{"POST", "/open", []string{"X-Csrf"}, http.StatusOK},
+		{"PATCH", "/open", nil, http.StatusForbidden},
+		{"PATCH", "/open", []string{"X-Csrf"}, http.StatusOK},
+		{"GET", "/auth", nil, http.StatusUnauthorized},
+		{"GET", "/auth", []string{"X-Auth"}, http.StatusOK},
+		{"GET", "/csrf", nil, http.StatusForbidden},
+		{"GET", "/csrf", []string{"X-Csrf"}, http.StatusOK},
+		{"GET", "/any", nil, http.StatusOK},
+		{"POST", "/any", nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := newRequest(test.method, "http://localhost"+test.path)
+		for _, h := range test.headers {
+			req.Header.Set(h, "1")
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s %s %v: code %d, want %d", test.method, test.path, test.headers, w.Code, test.code)
+		}
+	}
+}
+
+func Test_Walk(t *testing.T) {
+	r := NewRouter(false)
+	r.HandleFunc("/h", nopHandler).Name("h")
+	r.Get("/c/{id}", &testCtxHandler{}).Put(&testPutHandler{}).OnlyScheme("https")
+	r.Controller("/ctrl", &testController{}).SetSlashOption(RedictEndSlash)
+	r.addHandlerRoute(r.newHandlerRouteItem().PathPrefix("/static/"))
+	r.HandleFunc("{bad", nopHandler)
+
+	infos := r.Routes()
+	expect(t, len(infos), 5)
+	expect(t, infos[0].Kind, KindHandler)
+	expect(t, infos[0].Name, "h")
+	expect(t, infos[0].Handler, "http.HandlerFunc")
+	expect(t, infos[1].Kind, KindContext)
+	expect(t, infos[1].Template, "/c/{id}")
+	expect(t, fmt.Sprint(infos[1].Methods), "[GET PUT]")
+	expect(t, infos[1].OnlyScheme, "https")
+	expect(t, infos[1].Handler, "GET:route.testCtxHandler PUT:route.testPutHandler")
+	expect(t, infos[2].Kind, KindController)
+	expect(t, infos[2].Handler, "route.testController")
+	expect(t, infos[2].SlashOption, "redirect")
+	expect(t, infos[3].Prefix, true)
+	expect(t, infos[4].Index, 4)
+	refute(t, infos[4].Error, "")
+
+	w := httptest.NewRecorder()
+	r.RoutesHandler().ServeHTTP(w, newRequest("GET", "http://localhost/debug/routes?format=json"))
+	expect(t, w.Header().Get("Content-Type"), "application/json;charset=UTF-8")
+	w = httptest.NewRecorder()
+	r.RoutesHandler().ServeHTTP(w, newRequest("GET", "http://localhost/debug/routes"))
+	if !strings.Contains(w.Body.String(), "/c/{id}") {
+		t.Errorf("routes listing must contain the templates:\n%s", w.Body.String())
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	r := NewRouter(false)
+	r.HandleFunc("/a/{id}", nopHandler)
+	r.HandleFunc("{bad", nopHandler)
+	r.HandleFunc("/a/{id}", nopHandler)
+	r.addHandlerRoute(r.newHandlerRouteItem().PathPrefix("/static/").HandlerFunc(nopHandler))
+	r.HandleFunc("/static/{file}", nopHandler)
+	r.HandleFunc("/static", nopHandler)
+	r.Get("/g", &testCtxHandler{})
+	r.Post("/g", &testCtxHandler{})
+	r.HandleFunc("/h", nopHandler).Headers("X-Test", "1")
+	r.HandleFunc("/h", nopHandler)
+
+	err := r.Validate()
+	errs, ok := err.(RouteErrors)
+	if !ok {
+		t.Fatalf("Validate must return RouteErrors, got %v", err)
+	}
+	expect(t, len(errs), 3)
+	for i, want := range []string{"route #1", "route #2 \"/a/{id}\": duplicate of route #0", "route #4 \"/static/{file}\": unreachable, shadowed by route #3"} {
+		if i < len(errs) && !strings.HasPrefix(errs[i].Error(), want) {
+			t.Errorf("error %d: %q, want prefix %q", i, errs[i].Error(), want)
+		}
+	}
+
+	if err := NewRouter(false).Validate(); err != nil {
+		t.Errorf("empty router must be valid, got %v", err)
+	}
+}
+
+func Test_StrictRoutes(t *testing.T) {
+	r := NewRouter(false)
+	r.StrictRoutes = true
+	defer func() {
+		if recover() == nil {
+			t.Errorf("StrictRoutes must panic on a route error")
+		}
+	}()
+	r.HandleFunc("/a/{id", nopHandler)
+}
+
+func Test_Static(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte(strings.Repeat("var a = 1;\n", 100)), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "app.js.gz"), []byte("precompressed"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "logo.png"), []byte("png"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data.bin1"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data.bin1.gz"), []byte("\x1f\x8b\x08gzipped"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "index.html"), []byte("index"), 0644)
+	ioutil.WriteFile(filepath.Join(filepath.Dir(dir), "secret.txt"), []byte("secret"), 0644)
+	defer os.Remove(filepath.Join(filepath.Dir(dir), "secret.txt"))
+
+	r := NewRouter(false)
+	r.Static("/static/", dir)
+
+	serve := func(url string, header ...string) *httptest.ResponseRecorder {
+		req := newRequest("GET", url)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("http://localhost/static/app.js", "Accept-Encoding", "deflate")
+	expect(t, w.Code, 200)
+	expect(t, w.Header().Get("Content-Encoding"), "deflate")
+	expect(t, w.Header().Get("Vary"), "Accept-Encoding")
+	refute(t, w.Header().Get("Last-Modified"), "")
+
+	w = serve("http://localhost/static/app.js", "Accept-Encoding", "gzip, deflate")
+	expect(t, w.Header().Get("Content-Encoding"), "gzip")
+	expect(t, w.Body.String(), "precompressed")
+
+	w = serve("http://localhost/static/app.js")
+	expect(t, w.Header().Get("Content-Encoding"), "")
+	expect(t, w.Body.Len(), 1100)
+
+	w = serve("http://localhost/static/app.js", "If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	expect(t, w.Code, 304)
+
+	w = serve("http://localhost/static/logo.png", "Accept-Encoding", "gzip")
+	expect(t, w.Header().Get("Content-Encoding"), "")
+	expect(t, w.Header().Get("Content-Type"), "image/png")
+	expect(t, w.Body.String(), "png")
+
+	// The type of a precompressed file is not sniffed from the gzip bytes.
+	w = serve("http://localhost/static/data.bin1", "Accept-Encoding", "gzip")
+	expect(t, w.Header().Get("Content-Encoding"), "gzip")
+	expect(t, w.Header().Get("Content-Type"), "application/octet-stream")
+
+	w = serve("http://localhost/static/sub/")
+	expect(t, w.Body.String(), "index")
+
+	for _, url := range []string{"/static/../secret.txt", "/static/%2e%2e/secret.txt", "/static/sub/../../secret.txt", "/static/..%5csecret.txt", "/static/missing"} {
+		w = serve("http://localhost" + url)
+		if w.Code != 404 {
+			t.Errorf("%s: got %d %q, want 404", url, w.Code, w.Body.String())
+		}
+	}
+
+	// Without trailing slash, the prefix matches whole segments.
+	r.Static("/assets", dir)
+	other := r.HandleFunc("/assetsub/index.html", nopHandler)
+	w = serve("http://localhost/assets/logo.png")
+	expect(t, w.Body.String(), "png")
+	w = serve("http://localhost/assetsub/index.html")
+	expect(t, w.Body.String(), "")
+	if r.Match(newRequest("GET", "http://localhost/assetsub/index.html")) != other {
+		t.Errorf("/assets must not serve /assetsub")
+	}
+}
+
+func Test_VirtualHost(t *testing.T) {
+	r := NewRouter(false)
+	// Registered first, wins over the virtual hosts.
+	r.HandleFunc("/robots.txt", nopHandler)
+	www := r.Host("www.example.com")
+	wwwHome := www.HandleFunc("/", nopHandler)
+
+	tenants := r.Host("{tenant}.example.com")
+	tenants.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte("tenant"))
+	})
+	home := tenants.HandleFunc("/", nopHandler)
+	var filtered bool
+	tenants.InsertFilterFunc(BeforeExec, func(w http.ResponseWriter, req *http.Request) bool {
+		filtered = true
+		return true
+	})
+	shared := r.HandleFunc("/", nopHandler)
+	tenantRobots := tenants.HandleFunc("/robots.txt", nopHandler)
+
+	tests := []struct {
+		url   string
+		route RouteItem
+	}{
+		{"http://acme.example.com/", home},
+		{"http://www.example.com/", wwwHome},
+		{"http://example.com/", shared},
+		{"http://a.b.example.com/", shared},
+	}
+	for _, test := range tests {
+		if got := r.Match(newRequest("GET", test.url)); got != test.route {
+			t.Errorf("Match(%q) = %v, want %v", test.url, got, test.route)
+		}
+	}
+
+	// Routes without host still serve the virtual hosts, in registration
+	// order.
+	req := newRequest("GET", "http://acme.example.com/robots.txt")
+	refute(t, r.Match(req), nil)
+	refute(t, r.Match(req), tenantRobots)
+
+	req = newRequest("GET", "http://acme.example.com/")
+	expect(t, home.GetRouteParams(req)["tenant"], "acme")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	expect(t, filtered, true)
+
+	w = httptest.NewRecorder()
+	tenants.HandleFunc("/only", nopHandler)
+	r.ServeHTTP(w, newRequest("GET", "http://acme.example.com/missing"))
+	expect(t, w.Code, 404)
+	expect(t, w.Body.String(), "tenant")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://example.com/missing"))
+	expect(t, w.Body.String(), "404 page not found\n")
+	www.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte("www"))
+	})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://www.example.com/missing"))
+	expect(t, w.Body.String(), "www")
+
+	// Only the tenant robots.txt is shadowed, by the route without host.
+	err := r.Validate()
+	if err == nil || strings.Count(err.Error(), "shadow") != 1 || !strings.Contains(err.Error(), "{tenant}.example.com/robots.txt") {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func Test_TrustedProxies(t *testing.T) {
+	if err := context.SetTrustedProxies("10.0.0.0/8", "::1"); err != nil {
+		t.Fatal(err)
+	}
+	defer context.SetTrustedProxies()
+	if context.SetTrustedProxies("10.0.0.300/8") == nil {
+		t.Errorf("invalid CIDR must be an error")
+	}
+
+	r := NewRouterWithHost("http://www.domain.com", "https://www.domain.com", true, false)
+	r.HandleFunc("/secure", nopHandler).OnlyScheme("https")
+
+	request := func(remote string, header ...string) *http.Request {
+		req := newRequest("GET", "http://www.domain.com/secure")
+		req.RequestURI = "/secure"
+		req.RemoteAddr = remote
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		return req
+	}
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	expect(t, serve(request("10.1.2.3:1234", "X-Forwarded-Proto", "https")), 200)
+	expect(t, serve(request("[::1]:1234", "Forwarded", "for=1.2.3.4;proto=https")), 200)
+	expect(t, serve(request("1.2.3.4:1234", "X-Forwarded-Proto", "https")), 308)
+	expect(t, serve(request("1.2.3.4:1234", "X-Scheme", "https")), 308)
+
+	tests := []struct {
+		req   *http.Request
+		ip    string
+		proxy []string
+		host  string
+	}{
+		{request("1.2.3.4:1234", "X-Forwarded-For", "5.6.7.8", "X-Forwarded-Host", "evil.com"), "1.2.3.4", []string{}, "www.domain.com"},
+		{request("10.0.0.1:1234", "X-Forwarded-For", "5.6.7.8, 10.0.0.2", "X-Forwarded-Host", "a.domain.com"), "5.6.7.8", []string{"5.6.7.8", "10.0.0.2"}, "a.domain.com"},
+		// The spoofed address on the left of the client is ignored.
+		{request("10.0.0.1:1234", "X-Forwarded-For", "6.6.6.6, 5.6.7.8"), "5.6.7.8", []string{"5.6.7.8"}, "www.domain.com"},
+		{request("10.0.0.1:1234", "Forwarded", `for="[2001:db8::1]:4711";proto=https;host=b.domain.com, for=10.0.0.2;proto=http`), "2001:db8::1", []string{"2001:db8::1", "10.0.0.2"}, "b.domain.com"},
+		// Commas and semicolons in quoted strings don't split.
+		{request("10.0.0.1:1234", "Forwarded", `for=5.6.7.8;ext="a,b;c=\"d\"";host="c.domain.com", for=10.0.0.2`), "5.6.7.8", []string{"5.6.7.8", "10.0.0.2"}, "c.domain.com"},
+		{request("10.0.0.1:1234", "X-Real-IP", "5.6.7.8"), "5.6.7.8", []string{"5.6.7.8"}, "www.domain.com"},
+		{request("1.2.3.4:1234", "X-Real-IP", "5.6.7.8"), "1.2.3.4", []string{}, "www.domain.com"},
+	}
+	for i, test := range tests {
+		test.req.Host = "www.domain.com"
+		ctx := &context.Context{R: test.req}
+		expect(t, ctx.IP(), test.ip)
+		if got := fmt.Sprint(ctx.Proxy()); got != fmt.Sprint(test.proxy) {
+			t.Errorf("%d: Proxy() = %s, want %v", i, got, test.proxy)
+		}
+		expect(t, ctx.Host(), test.host)
+	}
+	expect(t, (&context.Context{R: tests[3].req}).Scheme(), "https")
+}
+
+func Test_SchemePolicy(t *testing.T) {
+	r := NewRouterWithHost("", "https://www.domain.com", true, false)
+	expect(t, r.SchemePolicy(), ConfigSchemePolicy())
+	func(expose bool) {
+		defer func() { beego.HttpsExposeURL = expose }()
+		beego.HttpsExposeURL = true
+		expect(t, NewRouter(false).SchemePolicy().HttpsPort, 443)
+	}(beego.HttpsExposeURL)
+	// The ports of the router hosts.
+	r.SetSchemePolicy(SchemePolicy{})
+	r.HandleFunc("/secure", nopHandler).OnlyScheme("https")
+	plain := r.HandleFunc("/plain", nopHandler).OnlyScheme("http")
+
+	serve := func(h http.Handler, method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := newRequest(method, url)
+		if strings.HasPrefix(url, "https") {
+			req.TLS = &tls.ConnectionState{}
+		}
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(r, "POST", "http://localhost:8080/secure?a=1")
+	expect(t, w.Code, 308)
+	expect(t, w.Header().Get("Location"), "https://www.domain.com/secure?a=1")
+	// No http host: the host of the request, on the http port of the policy.
+	w = serve(r, "GET", "https://localhost:4043/plain")
+	expect(t, w.Header().Get("Location"), "http://localhost/plain")
+
+	r.SetSchemePolicy(SchemePolicy{
+		RedirectStatus:        http.StatusMovedPermanently,
+		HttpPort:              8080,
+		HttpsPort:             4043,
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubDomains: true,
+		HSTSPreload:           true,
+	})
+	w = serve(r, "GET", "http://localhost:8080/secure")
+	expect(t, w.Code, 301)
+	expect(t, w.Header().Get("Location"), "https://www.domain.com:4043/secure")
+	expect(t, w.Header().Get("Strict-Transport-Security"), "")
+	w = serve(r, "GET", "https://localhost:4043/plain")
+	expect(t, w.Header().Get("Location"), "http://localhost:8080/plain")
+	// The browser would upgrade the redirect to http back to https.
+	expect(t, w.Header().Get("Strict-Transport-Security"), "")
+	w = serve(r, "GET", "https://localhost:4043/secure")
+	expect(t, w.Code, 200)
+	expect(t, w.Header().Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains; preload")
+	// With HSTS, the controllers are not served on http by default.
+	ctrl := r.Controller("/ctrl", &testController{})
+	w = serve(r, "GET", "https://localhost:4043/ctrl")
+	refute(t, w.Code, 301)
+	expect(t, w.Header().Get("Strict-Transport-Security"), "max-age=31536000; includeSubDomains; preload")
+	ctrl.OnlyScheme("http")
+	w = serve(r, "GET", "https://localhost:4043/ctrl")
+	expect(t, w.Code, 301)
+	expect(t, w.Header().Get("Strict-Transport-Security"), "")
+	u, _ := plain.URL()
+	expect(t, u.String(), "/plain")
+
+	w = serve(r.RedirectHandler(), "GET", "http://localhost:8080/any/path?q=1")
+	expect(t, w.Code, 301)
+	expect(t, w.Header().Get("Location"), "https://www.domain.com:4043/any/path?q=1")
+
+	expect(t, hostWithPort("[::1]:8080", 443, "https"), "[::1]")
+	expect(t, hostWithPort("::1", 8443, "https"), "[::1]:8443")
+	expect(t, hostWithPort("a.com:81", 0, "http"), "a.com:81")
+}
+
+func Test_Mount(t *testing.T) {
+	var got *http.Request
+	app := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+	})
+	r := NewRouter(false)
+	r.Mount("/admin/", app).SetSlashOption(RedictEndSlash)
+	r.Group("/t/{tenant}").Mount("/metrics", app)
+	r.HandleFunc("/administrator", nopHandler)
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		got = nil
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newRequest(method, url))
+		return w
+	}
+
+	serve("GET", "http://localhost/admin/users?page=2")
+	expect(t, got.URL.Path, "/users")
+	expect(t, got.URL.RawQuery, "page=2")
+	expect(t, got.RequestURI, "/users?page=2")
+	expect(t, got.Header.Get("X-Forwarded-Prefix"), "/admin")
+	expect(t, MountedPath(got), "/admin/users")
+
+	serve("POST", "http://localhost/admin/")
+	expect(t, got.URL.Path, "/")
+
+	w := serve("POST", "http://localhost/admin?x=1")
+	expect(t, w.Code, 307)
+	expect(t, w.Header().Get("Location"), "/admin/?x=1")
+
+	serve("GET", "http://localhost/administrator")
+	expect(t, got, (*http.Request)(nil))
+
+	serve("GET", "http://localhost/admin/a%2Fb/c")
+	expect(t, got.URL.Path, "/a/b/c")
+	expect(t, got.URL.RawPath, "/a%2Fb/c")
+
+	serve("GET", "http://localhost/t/acme/metrics/cpu")
+	expect(t, got.URL.Path, "/cpu")
+	expect(t, CurrentParams(got)["tenant"], "acme")
+	expect(t, got.Header.Get("X-Forwarded-Prefix"), "/t/acme/metrics")
+}
+
+func Test_RuntimeRegistration(t *testing.T) {
+	r := NewRouter(false)
+	r.HandleFunc("/a", nopHandler).Name("a")
+	r.HandleFunc("/{any}", nopHandler)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, url := range []string{"http://localhost/a", "http://localhost/b/1"} {
+					r.ServeHTTP(httptest.NewRecorder(), newRequest("GET", url))
+				}
+			}
+		}()
+	}
+
+	var b, a2 RouteItem
+	err := r.Update(func() {
+		b = r.Get("/b/{id:int}", &testCtxHandler{}).Name("b")
+		// Not published until the update returns.
+		if r.GetRoute("b") != nil {
+			t.Errorf("route published during Update")
+		}
+		a2 = r.HandleFunc("/a", nopHandler)
+		expect(t, r.ReplaceRoute("a", a2), nil)
+	})
+	expect(t, err, nil)
+	expect(t, r.GetRoute("b"), b)
+	expect(t, r.GetRoute("a"), a2)
+	expect(t, r.Match(newRequest("GET", "http://localhost/a")), a2)
+	expect(t, a2.GetName(), "a")
+	// a2 took the place of the replaced route, before "/{any}".
+	expect(t, r.Routes()[0].Name, "a")
+	expect(t, len(r.Routes()), 3)
+
+	r.AddService("Plugin", func(*context.Context, Databus) error { return nil })
+	expect(t, r.RemoveRoute("b"), true)
+	expect(t, r.RemoveRoute("b"), false)
+	refute(t, r.Match(newRequest("GET", "http://localhost/b/1")), b)
+
+	r.Freeze()
+	close(stop)
+	wg.Wait()
+	expectPanic := func(what string, f func()) {
+		defer func() {
+			if err := recover(); err != ErrFrozen {
+				t.Errorf("%s on a frozen router: recovered %v, want ErrFrozen", what, err)
+			}
+		}()
+		f()
+	}
+	expectPanic("HandleFunc", func() { r.HandleFunc("/late", nopHandler) })
+	expectPanic("AddService", func() { r.AddService("Late", func(*context.Context, Databus) error { return nil }) })
+	expect(t, len(r.Routes()), 2)
+	expect(t, r.RemoveRoute("a"), false)
+	expect(t, r.Update(func() {}), ErrFrozen)
+}
+
+func Test_RecoverPanic(t *testing.T) {
+	defer func(mode string, recoverPanic bool) {
+		beego.RunMode, beego.RecoverPanic = mode, recoverPanic
+		delete(middleware.ErrorMaps, "500")
+	}(beego.RunMode, beego.RecoverPanic)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	r := NewRouter(false)
+	r.HandleFunc("/panic", func(w http.ResponseWriter, req *http.Request) {
+		panic("boom")
+	})
+	r.HandleFunc("/half", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("half"))
+		panic("boom")
+	})
+	serve := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, newRequest("GET", url))
+		return w
+	}
+
+	beego.RunMode, beego.RecoverPanic = "prod", true
+	w := serve("http://localhost/panic")
+	expect(t, w.Code, 500)
+	expect(t, w.Body.String(), "Internal Server Error\n")
+	middleware.Errorhandler("500", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(500)
+		w.Write([]byte("custom"))
+	})
+	w = serve("http://localhost/panic")
+	expect(t, w.Body.String(), "custom")
+
+	beego.RunMode = "dev"
+	w = serve("http://localhost/panic")
+	expect(t, w.Code, 500)
+	if body := w.Body.String(); !strings.Contains(body, "boom") || !strings.Contains(body, "router_test.go") {
+		t.Errorf("dev mode must show the error and its stack:\n%s", body)
+	}
+
+	w = serve("http://localhost/half")
+	expect(t, w.Code, 200)
+	expect(t, w.Body.String(), "half")
+}
+
+type baseDBController struct {
+	beego.Controller
+	DB string `bmgo:"databus"`
+}
+
+type userController struct {
+	baseDBController
+	User     string `bmgo:"databus"`
+	prepared string
+}
+
+func (c *userController) Prepare() {
+	c.prepared = c.DB + "/" + c.User
+}
+
+func (c *userController) Get() {
+	c.Ctx.WriteString(c.prepared)
+}
+
+func Test_ControllerServices(t *testing.T) {
+	r := NewRouter(false)
+	r.AddService("DB", func(ctx *context.Context, bus Databus) error {
+		bus.Set("DB", "db")
+		return nil
+	})
+	r.AddService("User", func(ctx *context.Context, bus Databus) error {
+		if ctx.R.URL.Query().Get("anonymous") != "" {
+			return middleware.NewHTTPError(http.StatusUnauthorized, "")
+		}
+		bus.Set("User", "bob@"+bus.Get("DB").(string))
+		return nil
+	}, "DB")
+	route := r.Controller("/user", &userController{})
+	expect(t, route.GetError(), nil)
+
+	// Injected before Prepare, with the field of the embedded controller.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/user"))
+	expect(t, w.Body.String(), "db/bob@db")
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/user?anonymous=1"))
+	expect(t, w.Code, http.StatusUnauthorized)
+
+	// Planned as for the context handlers.
+	r2 := NewRouter(false)
+	r2.Controller("/user", &userController{})
+	r2.Controller("/ctrl", &testController{})
+	if errs, ok := r2.Validate().(RouteErrors); !ok || len(errs) != 1 {
+		t.Errorf("Validate must report the missing services of /user, got %v", r2.Validate())
+	}
+}
+
+type valueKey string
+
+type valueHandler struct {
+	User string `bmgo:"databus"`
+}
+
+func (h *valueHandler) ServeContext(ctx *context.Context) {
+	ctx.Set(valueKey("handler"), "done")
+	ctx.WriteString(fmt.Sprintf("%s %v %v", h.User, ctx.Get(valueKey("mw")), ctx.Get(valueKey("missing"))))
+}
+
+func Test_RequestValues(t *testing.T) {
+	var after interface{}
+	r := NewRouter(false)
+	r.FilterFunc(func(w http.ResponseWriter, req *http.Request) bool {
+		context.SetValue(req, valueKey("user"), "bob")
+		return true
+	})
+	r.InsertFilterFunc(AfterExec, func(w http.ResponseWriter, req *http.Request) bool {
+		after = req.Context().Value(valueKey("handler"))
+		return true
+	})
+	r.AddService("User", func(ctx *context.Context, bus Databus) error {
+		bus.Set("User", ctx.Get(valueKey("user")).(string))
+		return nil
+	})
+	r.Get("/values", &valueHandler{}).Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			// Read by the libraries through the request context.
+			if req.Context().Value(valueKey("user")) != "bob" {
+				t.Errorf("filter value not in the request context")
+			}
+			context.SetValue(req, valueKey("mw"), 1)
+			next.ServeHTTP(w, req)
+		})
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newRequest("GET", "http://localhost/values"))
+	expect(t, w.Body.String(), "bob 1 <nil>")
+	expect(t, after, "done")
+
+	// A Context outside of the router.
+	req := newRequest("GET", "http://localhost/values")
+	reqctx, cancel := stdcontext.WithTimeout(req.Context(), time.Minute)
+	ctx := &context.Context{R: req.WithContext(reqctx)}
+	ctx.Set(valueKey("a"), "b")
+	expect(t, ctx.Get(valueKey("a")), "b")
+	expect(t, ctx.Value(valueKey("a")), "b")
+	if _, ok := ctx.Deadline(); !ok {
+		t.Errorf("no deadline")
+	}
+	cancel()
+	<-ctx.Done()
+	expect(t, ctx.Err(), stdcontext.Canceled)
+}
+
+func Test_RegisterWhileServing(t *testing.T) {
+	r := NewRouter(false)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// A route is never published before its path is set.
+			if m := r.Match(newRequest("GET", "http://localhost/unrelated")); m != nil {
+				t.Errorf("partially built route matched")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		r.HandleFunc(fmt.Sprintf("/late/%d/{id}", i), nopHandler)
+		r.Get(fmt.Sprintf("/ctx/%d", i), &testCtxHandler{})
+	}
+	close(stop)
+	wg.Wait()
+	expect(t, len(r.Routes()), 100)
+}
+
+func benchmarkRouter(n int) (*Router, []*http.Request) {
+	r := NewRouter(false)
+	reqs := []*http.Request{}
+	for i := 0; i < n; i++ {
+		r.HandleFunc(fmt.Sprintf("/api/v1/resource%d/{id:[0-9]+}", i), nopHandler)
+		r.HandleFunc(fmt.Sprintf("/api/v1/resource%d/", i), nopHandler)
+		if i%(n/4) == 0 {
+			reqs = append(reqs, newRequest("GET", fmt.Sprintf("http://localhost/api/v1/resource%d/42", i)))
+		}
+	}
+	reqs = append(reqs, newRequest("GET", "http://localhost/api/v1/missing"))
+	return r, reqs
+}
+
+func BenchmarkMatchIndex400(b *testing.B) {
+	r, reqs := benchmarkRouter(200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, req := range reqs {
+			r.Match(req)
+		}
+	}
+}
+
+func BenchmarkMatchScan400(b *testing.B) {
+	r, reqs := benchmarkRouter(200)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, req := range reqs {
+			matchScan(r, req)
+		}
+	}
+}
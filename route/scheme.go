@@ -0,0 +1,160 @@
+package route
+
+import (
+	"fmt"
+	"github.com/smithfox/beego"
+	"github.com/smithfox/beego/context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// SchemePolicy configures the redirects between http and https done for the
+// routes with OnlyScheme, and the HSTS header of the https responses.
+type SchemePolicy struct {
+	// Status of the scheme redirects, 308 (http.StatusPermanentRedirect) by
+	// default: the method and body of a POST are kept.
+	RedirectStatus int
+	// Ports of the redirect and built URLs. 0 keeps the port of the router
+	// hosts, the default ports 80 and 443 are omitted.
+	HttpPort  int
+	HttpsPort int
+	// Max age in seconds of the Strict-Transport-Security header, the header
+	// is not sent if 0, nor with the redirects to http. With HSTS, the
+	// context handlers and controllers are no longer served on http only by
+	// default: the browsers would upgrade their redirects back to https.
+	HSTSMaxAge            int
+	HSTSIncludeSubDomains bool
+	HSTSPreload           bool
+}
+
+// ConfigSchemePolicy returns the policy of the beego configuration:
+// HttpPort, HttpsPort, HttpsExposeURL, HttpsRedirectStatus and Hsts*. It is
+// the policy of the new routers, so they are created once the configuration
+// is parsed. SetSchemePolicy overrides it.
+func ConfigSchemePolicy() SchemePolicy {
+	p := SchemePolicy{
+		RedirectStatus:        beego.HttpsRedirectStatus,
+		HttpPort:              beego.HttpPort,
+		HttpsPort:             beego.HttpsPort,
+		HSTSMaxAge:            beego.HstsMaxAge,
+		HSTSIncludeSubDomains: beego.HstsIncludeSubDomains,
+		HSTSPreload:           beego.HstsPreload,
+	}
+	if beego.HttpsExposeURL {
+		p.HttpPort, p.HttpsPort = 80, 443
+	}
+	return p
+}
+
+// SetSchemePolicy sets the scheme policy of the router and its groups.
+func (r *Router) SetSchemePolicy(p SchemePolicy) *Router {
+	r.root().schemePolicy = p
+	return r
+}
+
+// SchemePolicy returns the scheme policy of the router.
+func (r *Router) SchemePolicy() SchemePolicy {
+	return r.root().schemePolicy
+}
+
+func (p *SchemePolicy) redirectStatus() int {
+	if p.RedirectStatus == 0 {
+		return http.StatusPermanentRedirect
+	}
+	return p.RedirectStatus
+}
+
+func (p *SchemePolicy) port(scheme string) int {
+	if scheme == "https" {
+		return p.HttpsPort
+	}
+	return p.HttpPort
+}
+
+// hstsHeader returns the value of the Strict-Transport-Security header.
+func (p *SchemePolicy) hstsHeader() string {
+	if p.HSTSMaxAge <= 0 {
+		return ""
+	}
+	v := fmt.Sprintf("max-age=%d", p.HSTSMaxAge)
+	if p.HSTSIncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if p.HSTSPreload {
+		v += "; preload"
+	}
+	return v
+}
+
+// setHSTS adds the HSTS header to the responses of the https requests.
+// Browsers ignore it over http.
+func (p *SchemePolicy) setHSTS(w http.ResponseWriter, req *http.Request) {
+	if v := p.hstsHeader(); v != "" && context.RequestScheme(req) == "https" {
+		w.Header().Set("Strict-Transport-Security", v)
+	}
+}
+
+func defaultPort(scheme string) int {
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
+
+// hostWithPort sets the port of host for the scheme. The default port of the
+// scheme is omitted, port 0 keeps the port of host.
+func hostWithPort(host string, port int, scheme string) string {
+	if port == 0 {
+		return host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == defaultPort(scheme) {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+// schemeRedirectURL returns the URL of the request with the scheme: the host
+// of the router for the scheme, or else the host of the request, with the
+// port of the policy.
+func (r *Router) schemeRedirectURL(req *http.Request, scheme string) string {
+	r = r.root()
+	_, host := r.schemeHost(scheme)
+	if host == "" {
+		// The port of the other scheme is of no use.
+		port := r.schemePolicy.port(scheme)
+		if port == 0 {
+			port = defaultPort(scheme)
+		}
+		host = hostWithPort(context.RequestHost(req), port, scheme)
+	}
+	return scheme + "://" + host + req.URL.RequestURI()
+}
+
+// RedirectHandler returns a handler redirecting every request to https, for
+// an http listener serving nothing else:
+//
+//     go http.ListenAndServe(":80", r.RedirectHandler())
+//     http.ListenAndServeTLS(":443", cert, key, r)
+func (r *Router) RedirectHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		root := r.root()
+		http.Redirect(w, req, root.schemeRedirectURL(req, "https"), root.schemePolicy.redirectStatus())
+	})
+}
+
+// HttpHandler returns the handler of the http listener: RedirectHandler if
+// beego.HttpsRedirectOnly is set, else the router.
+func (r *Router) HttpHandler() http.Handler {
+	if beego.HttpsRedirectOnly {
+		return r.RedirectHandler()
+	}
+	return r.root()
+}
@@ -0,0 +1,406 @@
+package route
+
+import (
+	"fmt"
+	"github.com/smithfox/beego/context"
+	"github.com/smithfox/beego/middleware"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Scope is the lifecycle of the values of a Provider.
+type Scope int
+
+const (
+	// One value per request, shared by the fields of the request and
+	// released after the handler, see Provider.Close.
+	ScopeRequest Scope = iota
+	// One value for all the requests, created by the first one.
+	ScopeSingleton
+	// A new value for each field.
+	ScopeTransient
+)
+
+// Provider provides the values of the databus fields, see Router.Provide and
+// Router.ProvideType.
+type Provider struct {
+	Scope Scope
+	// New returns a value. The fields the provider depends on are set on the
+	// bus. An error stops the request, as the errors of DatabusService.
+	New func(*context.Context, Databus) (interface{}, error)
+	// Close releases a value of ScopeRequest after the handler. If nil, the
+	// Close method of the value is called if it has one.
+	Close func(interface{})
+}
+
+// busService is a databus service registered with Router.AddService, or a
+// provider registered with Router.Provide or Router.ProvideType.
+type busService struct {
+	// Field name or reflect.Type the service is registered for.
+	key      interface{}
+	service  DatabusService
+	provider *Provider
+	// The fields read by the service, resolved before it runs.
+	deps []string
+
+	// Value of a ScopeSingleton provider.
+	lock  sync.Mutex
+	done  bool
+	value interface{}
+}
+
+// busStep is a field resolved for a request by the service of key.
+type busStep struct {
+	field string
+	key   interface{}
+}
+
+// serviceCycle returns the cycle of dependencies going through the service
+// of key, e.g. [A B A], or nil if there is none. Dependencies without a
+// service are skipped, and the types are only known per bus: busPlan
+// reports them.
+func serviceCycle(services map[interface{}]*busService, key interface{}) []string {
+	var path []string
+	done := map[interface{}]bool{}
+	var visit func(key interface{}) bool
+	visit = func(key interface{}) bool {
+		for i, p := range path {
+			if p == fmt.Sprint(key) {
+				path = append(path[i:], p)
+				return true
+			}
+		}
+		s := services[key]
+		if s == nil || done[key] {
+			return false
+		}
+		path = append(path, fmt.Sprint(key))
+		for _, dep := range s.deps {
+			if visit(dep) {
+				return true
+			}
+		}
+		path = path[:len(path)-1]
+		done[key] = true
+		return false
+	}
+	if visit(key) {
+		return path
+	}
+	return nil
+}
+
+// lookupService returns the service of a field: the one registered for its
+// name, else for its type.
+func lookupService(services map[interface{}]*busService, name string, t reflect.Type) (interface{}, *busService) {
+	if s := services[name]; s != nil {
+		return name, s
+	}
+	if s := services[t]; s != nil {
+		return t, s
+	}
+	return nil, nil
+}
+
+// busPlan returns the fields of the bus type resolved for a request, in the
+// order their services run: the databus fields and, before them, the fields
+// their services depend on. The other fields and services are skipped, and
+// each field is resolved once. The fields bound to the request are filled
+// before, see busTag.
+//
+// It fails on an invalid bmgo tag, if a field which is not optional has no
+// service, if a dependency is not a field of the bus, or on a cycle of
+// dependencies.
+func busPlan(services map[interface{}]*busService, bt *busType) ([]busStep, error) {
+	if bt.err != nil {
+		return nil, bt.err
+	}
+	const (
+		visiting = 1
+		resolved = 2
+	)
+	var plan []busStep
+	state := map[string]int{}
+	var visit func(field, by string) error
+	visit = func(field, by string) error {
+		switch state[field] {
+		case resolved:
+			return nil
+		case visiting:
+			return fmt.Errorf("mux: databus dependency cycle on the field %q of %s", field, bt.typ)
+		}
+		f, ok := bt.fields[field]
+		if !ok {
+			return fmt.Errorf("mux: databus service %q depends on %q, which is not a field of %s", by, field, bt.typ)
+		}
+		name := field
+		if f.tag != nil {
+			if f.tag.source != "" {
+				// Bound to the request.
+				return nil
+			}
+			if f.tag.name != "" {
+				name = f.tag.name
+			}
+		}
+		key, s := lookupService(services, name, f.typ)
+		if s == nil {
+			if f.tag != nil && f.tag.optional {
+				state[field] = resolved
+				return nil
+			}
+			return fmt.Errorf("mux: no databus service %q for the field %q (%s) of %s", name, field, f.typ, bt.typ)
+		}
+		state[field] = visiting
+		for _, dep := range s.deps {
+			if err := visit(dep, field); err != nil {
+				return err
+			}
+		}
+		state[field] = resolved
+		plan = append(plan, busStep{field: field, key: key})
+		return nil
+	}
+	for _, field := range bt.inject {
+		if err := visit(field, ""); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// busRun resolves the fields of the bus of a request, and releases the
+// per-request values after the handler.
+type busRun struct {
+	ctx *context.Context
+	bus *databus
+	// Values of the ScopeRequest providers, released in reverse order.
+	values  map[*busService]interface{}
+	created []*busService
+}
+
+func newBusRun(ctx *context.Context, bus *databus) *busRun {
+	return &busRun{ctx: ctx, bus: bus}
+}
+
+// resolve fills the fields bound to the request, then runs the services of
+// the plan, see busPlan. It stops at the first error, or when a service
+// wrote the response.
+func (run *busRun) resolve(services map[interface{}]*busService, plan []busStep) error {
+	if err := run.bind(); err != nil {
+		return err
+	}
+	for _, step := range plan {
+		s := services[step.key]
+		if s == nil {
+			return fmt.Errorf("mux: no databus service for the field %q", step.field)
+		}
+		if err := run.fill(s, step.field); err != nil {
+			return fmt.Errorf("mux: databus service %q: %w", step.field, err)
+		}
+		if run.ctx.Written() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// fill sets the field with the service.
+func (run *busRun) fill(s *busService, field string) error {
+	if s.service != nil {
+		return s.service(run.ctx, run.bus)
+	}
+	v, err := run.value(s)
+	if err != nil {
+		return err
+	}
+	if v != nil && !reflect.TypeOf(v).AssignableTo(run.bus.Type(field)) {
+		return fmt.Errorf("provided a %T, not assignable to %s", v, run.bus.Type(field))
+	}
+	run.bus.Set(field, v)
+	return nil
+}
+
+// value returns the value of a provider for its scope.
+func (run *busRun) value(s *busService) (interface{}, error) {
+	p := s.provider
+	switch p.Scope {
+	case ScopeSingleton:
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if !s.done {
+			v, err := p.New(run.ctx, run.bus)
+			if err != nil {
+				return nil, err
+			}
+			s.value, s.done = v, true
+		}
+		return s.value, nil
+	case ScopeTransient:
+		return p.New(run.ctx, run.bus)
+	}
+	if v, ok := run.values[s]; ok {
+		return v, nil
+	}
+	v, err := p.New(run.ctx, run.bus)
+	if err != nil {
+		return nil, err
+	}
+	if run.values == nil {
+		run.values = make(map[*busService]interface{})
+	}
+	run.values[s] = v
+	run.created = append(run.created, s)
+	return v, nil
+}
+
+// release closes the per-request values, the last created first.
+func (run *busRun) release() {
+	if run == nil {
+		return
+	}
+	for i := len(run.created) - 1; i >= 0; i-- {
+		s := run.created[i]
+		v := run.values[s]
+		if s.provider.Close != nil {
+			s.provider.Close(v)
+			continue
+		}
+		switch c := v.(type) {
+		case io.Closer:
+			if err := c.Close(); err != nil {
+				log.Printf("Router: closing %T: %v\n", v, err)
+			}
+		case interface{ Close() }:
+			c.Close()
+		}
+	}
+	run.values, run.created = nil, nil
+}
+
+// serviceFailed responds with the status of the error of a service, unless
+// the service already wrote the response. The server errors are logged.
+func serviceFailed(ctx *context.Context, err error) {
+	if middleware.ErrorStatus(err) >= http.StatusInternalServerError {
+		log.Printf("Router: %s %s: %v\n", ctx.R.Method, ctx.R.URL.Path, err)
+	}
+	if ctx.Written() {
+		return
+	}
+	middleware.ErrorException(err, ctx.W, ctx.R)
+	ctx.SetWritten()
+}
+
+// AddService registers the databus service filling the field with the name.
+// deps are the fields the service reads from the bus, their services run
+// before it:
+//
+//     r.AddService("DB", openDB)
+//     r.AddService("CurrentUser", loadUser, "DB")
+//
+// The services of a route are planned on its first request, and again after
+// the services changed: they can be added before or after the route. A
+// missing service fails the requests of the route with a 500, see Validate.
+// AddService fails if the dependencies make a cycle. It panics with
+// ErrFrozen if the router is frozen, as the route registrations.
+func (r *Router) AddService(name string, s DatabusService, deps ...string) error {
+	return r.addService(&busService{key: name, service: s, deps: deps})
+}
+
+// Provide registers the provider of the databus fields with the name. As
+// AddService, it fails on a cycle of dependencies.
+func (r *Router) Provide(name string, p Provider, deps ...string) error {
+	return r.addService(&busService{key: name, provider: &p, deps: deps})
+}
+
+// ProvideType registers the provider of the databus fields of type t, for
+// the fields without a service registered for their name:
+//
+//     r.ProvideType(reflect.TypeOf((*sql.DB)(nil)), Provider{
+//         Scope: ScopeSingleton,
+//         New: func(*context.Context, Databus) (interface{}, error) {
+//             return sql.Open("mysql", dsn)
+//         },
+//     })
+func (r *Router) ProvideType(t reflect.Type, p Provider, deps ...string) error {
+	return r.addService(&busService{key: t, provider: &p, deps: deps})
+}
+
+func (r *Router) addService(s *busService) error {
+	root := r.root()
+	root.lock.Lock()
+	defer root.lock.Unlock()
+	if root.frozen {
+		panic(ErrFrozen)
+	}
+	services := make(map[interface{}]*busService)
+	for k, v := range root.loadServices() {
+		services[k] = v
+	}
+	services[s.key] = s
+	if cycle := serviceCycle(services, s.key); cycle != nil {
+		return fmt.Errorf("mux: databus service dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	root.services.Store(&serviceSet{services: services})
+	return nil
+}
+
+// serviceSet holds the services of a router. A new one is stored by each
+// addService, so the plans made for it stay valid while it is loaded.
+type serviceSet struct {
+	services map[interface{}]*busService
+}
+
+func (r *Router) loadServiceSet() *serviceSet {
+	set, _ := r.root().services.Load().(*serviceSet)
+	return set
+}
+
+// loadServices returns the databus services of the root router.
+func (r *Router) loadServices() map[interface{}]*busService {
+	if set := r.loadServiceSet(); set != nil {
+		return set.services
+	}
+	return nil
+}
+
+// busPlanner keeps the plan of the bus type of a route handler, see busPlan.
+// It is made on first use and again when the services of the router change,
+// so a route can be registered before its services.
+type busPlanner struct {
+	router *Router
+	bt     *busType
+	// *busPlanned, the last plan.
+	last atomic.Value
+}
+
+type busPlanned struct {
+	set  *serviceSet
+	plan []busStep
+	err  error
+}
+
+func newBusPlanner(router *Router, bt *busType) *busPlanner {
+	return &busPlanner{router: router, bt: bt}
+}
+
+// plan returns the services of the router and the plan of the bus type for
+// them, or the error of busPlan.
+func (p *busPlanner) plan() (map[interface{}]*busService, []busStep, error) {
+	set := p.router.loadServiceSet()
+	var services map[interface{}]*busService
+	if set != nil {
+		services = set.services
+	}
+	if last, _ := p.last.Load().(*busPlanned); last != nil && last.set == set {
+		return services, last.plan, last.err
+	}
+	plan, err := busPlan(services, p.bt)
+	p.last.Store(&busPlanned{set: set, plan: plan, err: err})
+	return services, plan, err
+}
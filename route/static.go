@@ -0,0 +1,132 @@
+package route
+
+import (
+	"github.com/smithfox/beego"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Static serves the files of dir under the path prefix, for GET and HEAD.
+//
+// Files are read through beego.OpenMemZipFile, so they are cached in memory,
+// compressed with gzip or deflate as accepted by the client, up to
+// beego.MemZipMaxFileSize. A "file.gz" sibling newer than "file" is served
+// as is to gzip clients. A compressed file whose extension has no known type
+// is served as application/octet-stream. Types which are already compressed
+// (images, archives...) are never compressed again.
+// Last-Modified/If-Modified-Since and ranges are handled by
+// http.ServeContent. Paths can't go out of dir, directories are served by
+// their index.html only.
+//
+//     r.Static("/static/", "./static")
+func (r *Router) Static(prefix, dir string) *HandlerRouteItem {
+	routeitem := r.newHandlerRouteItem()
+	h := &staticHandler{routeitem: routeitem, dir: dir}
+	routeitem.PathPrefix(prefix)._methods("GET", "HEAD")
+	routeitem.addMatcher(h)
+	return r.addHandlerRoute(routeitem.Handler(h))
+}
+
+// Extensions of the files never compressed by Static.
+var staticCompressedExts = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".bz2": true, ".xz": true, ".7z": true, ".rar": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".ogg": true, ".webm": true, ".avi": true, ".mov": true,
+	".woff": true, ".woff2": true, ".pdf": true,
+}
+
+// staticHandler serves the files. It is also a matcher of its route, the
+// prefix matches whole segments: "/static" does not serve "/staticx/a.txt".
+type staticHandler struct {
+	routeitem *HandlerRouteItem
+	dir       string
+}
+
+func (h *staticHandler) Match(req *http.Request) bool {
+	_, ok := splitPrefix(h.routeitem.pathRegexp(), req.URL.Path)
+	return ok
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, ok := h.fileName(req)
+	if !ok {
+		h.notFound(w, req)
+		return
+	}
+	fi, err := os.Stat(name)
+	if err == nil && fi.IsDir() {
+		name = filepath.Join(name, "index.html")
+		fi, err = os.Stat(name)
+	}
+	if err != nil || fi.IsDir() {
+		h.notFound(w, req)
+		return
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	zip := ""
+	if !staticCompressedExts[ext] {
+		w.Header().Add("Vary", "Accept-Encoding")
+		zip = beego.GetAcceptEncodingZip(req)
+	}
+	if ctype := mime.TypeByExtension(ext); ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	file, gz := name, false
+	if zip == "gzip" {
+		// A precompressed sibling, served without compressing again.
+		if gzfi, err := os.Stat(name + ".gz"); err == nil && !gzfi.IsDir() && !gzfi.ModTime().Before(fi.ModTime()) {
+			file, zip, gz = name+".gz", "", true
+		}
+	}
+	if beego.MemZipMaxFileSize <= 0 || fi.Size() > beego.MemZipMaxFileSize {
+		// Large files are streamed from disk, not compressed on each request.
+		zip = ""
+	}
+	memfile, err := beego.OpenMemZipFile(file, zip)
+	if err != nil {
+		h.notFound(w, req)
+		return
+	}
+	defer memfile.Close()
+	if gz {
+		w.Header().Set("Content-Encoding", "gzip")
+	} else if memfile.Zip() != "" {
+		w.Header().Set("Content-Encoding", memfile.Zip())
+	}
+	if w.Header().Get("Content-Encoding") != "" && w.Header().Get("Content-Type") == "" {
+		// ServeContent would sniff the compressed bytes.
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	http.ServeContent(w, req, fi.Name(), fi.ModTime(), memfile)
+}
+
+// fileName returns the file for the request path, relative to the prefix of
+// the route. It returns false if the path goes out of dir.
+func (h *staticHandler) fileName(req *http.Request) (string, bool) {
+	n, ok := splitPrefix(h.routeitem.pathRegexp(), req.URL.Path)
+	if !ok {
+		return "", false
+	}
+	rel := req.URL.Path[n:]
+	if strings.Contains(rel, "\x00") || strings.Contains(rel, "\\") {
+		return "", false
+	}
+	// Cleaning a rooted path removes all the "..".
+	rel = path.Clean("/" + rel)
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join(h.dir, filepath.FromSlash(rel)), true
+}
+
+func (h *staticHandler) notFound(w http.ResponseWriter, req *http.Request) {
+	h.routeitem.Router.root().notFoundHandler(req).ServeHTTP(w, req)
+}
@@ -0,0 +1,205 @@
+package route
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrFrozen is the error of the changes to a frozen router, see
+// Router.Freeze.
+var ErrFrozen = errors.New("mux: router is frozen, routes can't be registered")
+
+// routeTable is a snapshot of the routes of a router. A published table is
+// never modified: registrations copy it and swap the copy in, so matching
+// needs no lock.
+type routeTable struct {
+	// Routes to be matched, in order.
+	routes []RouteItem
+	// Routes registered with a name, used to build URLs.
+	named map[string]RouteItem
+	// Groups created from the router.
+	groups []*Router
+	// Prefix tree over routes, built on the first Match.
+	index atomic.Value
+}
+
+var emptyTable = &routeTable{named: map[string]RouteItem{}}
+
+func (t *routeTable) clone() *routeTable {
+	c := &routeTable{
+		routes: append([]RouteItem(nil), t.routes...),
+		named:  make(map[string]RouteItem, len(t.named)),
+		groups: append([]*Router(nil), t.groups...),
+	}
+	for name, routeitem := range t.named {
+		c.named[name] = routeitem
+	}
+	return c
+}
+
+func (t *routeTable) getIndex() *routeIndex {
+	idx, _ := t.index.Load().(*routeIndex)
+	if idx == nil {
+		idx = newRouteIndex(t.routes)
+		t.index.Store(idx)
+	}
+	return idx
+}
+
+// loadTable returns the published routes of the root router.
+func (r *Router) loadTable() *routeTable {
+	if t, ok := r.root().table.Load().(*routeTable); ok {
+		return t
+	}
+	return emptyTable
+}
+
+// editTable runs fn on a copy of the routes and publishes it, or on the
+// pending routes during Update. It fails with ErrFrozen if check is true and
+// the router is frozen.
+func (r *Router) editTable(check bool, fn func(t *routeTable) error) error {
+	root := r.root()
+	root.lock.Lock()
+	defer root.lock.Unlock()
+	if check && root.frozen {
+		return ErrFrozen
+	}
+	t := root.pending
+	if t == nil {
+		t = root.loadTable().clone()
+	}
+	if err := fn(t); err != nil {
+		return err
+	}
+	if root.pending == nil {
+		root.table.Store(t)
+	}
+	return nil
+}
+
+// routesChanged drops the route index after a route changed its path or
+// host, it is rebuilt on the next Match.
+func (r *Router) routesChanged() {
+	root := r.root()
+	root.lock.Lock()
+	defer root.lock.Unlock()
+	if root.pending != nil {
+		// Indexed when published.
+		return
+	}
+	t := root.loadTable()
+	root.table.Store(&routeTable{routes: t.routes, named: t.named, groups: t.groups})
+}
+
+// Update registers routes while the router serves requests. The routes
+// registered, removed or replaced by fn are published at once when fn
+// returns: requests never see a partially built route. Updates are
+// serialized.
+//
+// Outside of Update, a route is published when its registration, e.g.
+// Router.Get, returns: the options set on it afterwards, like Name or
+// OnlyScheme, race with the requests being served.
+//
+//     r.Update(func() {
+//         r.Get("/plugin/{id}", &PluginHandler{}).Name("plugin")
+//     })
+func (r *Router) Update(fn func()) error {
+	root := r.root()
+	root.updateLock.Lock()
+	defer root.updateLock.Unlock()
+
+	root.lock.Lock()
+	if root.frozen {
+		root.lock.Unlock()
+		return ErrFrozen
+	}
+	root.pending = root.loadTable().clone()
+	root.lock.Unlock()
+
+	done := false
+	defer func() {
+		root.lock.Lock()
+		// Nothing is published if fn panics.
+		if done {
+			root.table.Store(root.pending)
+		}
+		root.pending = nil
+		root.lock.Unlock()
+	}()
+	fn()
+	done = true
+	return nil
+}
+
+// RemoveRoute removes the route registered with the name. It returns false
+// if there is none or if the router is frozen.
+func (r *Router) RemoveRoute(name string) bool {
+	err := r.editTable(true, func(t *routeTable) error {
+		routeitem, ok := t.named[name]
+		if !ok {
+			return fmt.Errorf("mux: no route named %q", name)
+		}
+		delete(t.named, name)
+		t.routes = removeRouteItem(t.routes, routeitem)
+		return nil
+	})
+	return err == nil
+}
+
+// ReplaceRoute replaces the route registered with the name by routeitem,
+// which takes its name and its place in the match order. routeitem is
+// usually registered just before, within the same Update:
+//
+//     r.Update(func() {
+//         r.ReplaceRoute("plugin", r.Get("/plugin/{id}", &PluginHandlerV2{}))
+//     })
+func (r *Router) ReplaceRoute(name string, routeitem RouteItem) error {
+	b, ok := routeitem.(baseRouteItem)
+	if !ok {
+		return fmt.Errorf("mux: can't replace route %q by a %T", name, routeitem)
+	}
+	item := b.base()
+	if item.err != nil {
+		return item.err
+	}
+	return r.editTable(true, func(t *routeTable) error {
+		old, ok := t.named[name]
+		if !ok {
+			return fmt.Errorf("mux: no route named %q", name)
+		}
+		if item.name != "" {
+			return fmt.Errorf("mux: route already has name %q, can't set %q", item.name, name)
+		}
+		t.routes = removeRouteItem(t.routes, routeitem)
+		for i := range t.routes {
+			if t.routes[i] == old {
+				t.routes[i] = routeitem
+			}
+		}
+		t.named[name] = routeitem
+		item.name = name
+		return nil
+	})
+}
+
+// Freeze makes the later changes fail with ErrFrozen: the registrations of
+// routes and services panic with it, Update and ReplaceRoute return it and
+// RemoveRoute returns false.
+func (r *Router) Freeze() {
+	root := r.root()
+	root.lock.Lock()
+	root.frozen = true
+	root.lock.Unlock()
+}
+
+// removeRouteItem returns the routes without routeitem.
+func removeRouteItem(routes []RouteItem, routeitem RouteItem) []RouteItem {
+	kept := routes[:0]
+	for _, ri := range routes {
+		if ri != routeitem {
+			kept = append(kept, ri)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,176 @@
+package route
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RouteErrors lists the problems found by Router.Validate.
+type RouteErrors []error
+
+func (e RouteErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// busChecker is implemented by the route items whose handlers have a
+// databus.
+type busChecker interface {
+	busError() error
+}
+
+// baseRouteItem is implemented by the route items built on HandlerRouteItem.
+type baseRouteItem interface {
+	base() *HandlerRouteItem
+}
+
+func (r *HandlerRouteItem) base() *HandlerRouteItem {
+	return r
+}
+
+// Validate checks the registered routes. It returns a RouteErrors with:
+//
+// - the errors resulted from building routes and groups, such routes never
+// match, and the filters inserted at an invalid position;
+//
+// - the duplicated route names, see HandlerRouteItem.Name;
+//
+// - the databus fields of the handlers without service, see AddService;
+//
+// - the duplicated routes and the routes which can never be reached because
+// an earlier route, a PathPrefix for example, matches all their requests.
+func (r *Router) Validate() error {
+	t := r.loadTable()
+	var errs RouteErrors
+	if err := r.root().filterErr; err != nil {
+		errs = append(errs, err)
+	}
+	for _, g := range t.groups {
+		if g.groupErr != nil {
+			errs = append(errs, fmt.Errorf("group %q: %v", g.host+g.prefix, g.groupErr))
+		}
+		if g.filterErr != nil {
+			errs = append(errs, fmt.Errorf("group %q: %v", g.host+g.prefix, g.filterErr))
+		}
+	}
+	for i, routeitem := range t.routes {
+		b, ok := routeitem.(baseRouteItem)
+		if !ok {
+			continue
+		}
+		later := b.base()
+		if later.err != nil {
+			errs = append(errs, fmt.Errorf("route #%d %s: %v", i, later.describe(), later.err))
+			continue
+		}
+		if later.nameErr != nil {
+			errs = append(errs, fmt.Errorf("route #%d %s: %v", i, later.describe(), later.nameErr))
+		}
+		if bc, ok := routeitem.(busChecker); ok {
+			if err := bc.busError(); err != nil {
+				errs = append(errs, fmt.Errorf("route #%d %s: %v", i, later.describe(), err))
+			}
+		}
+		for j := 0; j < i; j++ {
+			b, ok := t.routes[j].(baseRouteItem)
+			if !ok {
+				continue
+			}
+			earlier := b.base()
+			if dup, shadow := earlier.covers(later); dup {
+				errs = append(errs, fmt.Errorf("route #%d %s: duplicate of route #%d", i, later.describe(), j))
+				break
+			} else if shadow {
+				errs = append(errs, fmt.Errorf("route #%d %s: unreachable, shadowed by route #%d %s", i, later.describe(), j, earlier.describe()))
+				break
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// MustValidate panics if Validate finds a problem.
+func (r *Router) MustValidate() {
+	if err := r.Validate(); err != nil {
+		panic(err)
+	}
+}
+
+// describe returns the host and path templates of the route, for messages.
+func (r *HandlerRouteItem) describe() string {
+	s := ""
+	if r.regexp != nil && r.regexp.host != nil {
+		s = r.regexp.host.template
+	}
+	if r.regexp != nil && r.regexp.path != nil {
+		s += r.regexp.path.template
+	}
+	if r.name != "" {
+		s += " (" + r.name + ")"
+	}
+	return fmt.Sprintf("%q", s)
+}
+
+// covers tells whether all the requests matched by the later route are
+// matched by r. dup is true if both routes have the same templates.
+// Routes with other matchers (headers, queries, functions) are never
+// reported, their conditions can't be compared.
+func (r *HandlerRouteItem) covers(later *HandlerRouteItem) (dup, shadow bool) {
+	if r.err != nil || r.buildOnly || later.buildOnly || r.hasCustomMatchers() || later.hasCustomMatchers() {
+		return false, false
+	}
+	// Methods: r must accept all the methods of later.
+	if len(r.methods) > 0 {
+		if len(later.methods) == 0 {
+			return false, false
+		}
+		for _, m := range later.methods {
+			if !matchInArray(r.methods, m) {
+				return false, false
+			}
+		}
+	}
+	var rHost, lHost, rPath, lPath *routeRegexp
+	if r.regexp != nil {
+		rHost, rPath = r.regexp.host, r.regexp.path
+	}
+	if later.regexp != nil {
+		lHost, lPath = later.regexp.host, later.regexp.path
+	}
+	// A route without host covers the routes of every host, not the reverse.
+	if rHost != nil && (lHost == nil || rHost.regexp.String() != lHost.regexp.String()) {
+		return false, false
+	}
+	sameMethods := len(r.methods) == len(later.methods) && (rHost == nil) == (lHost == nil)
+	if rPath == nil {
+		return lPath == nil && sameMethods, true
+	}
+	if lPath == nil {
+		return false, false
+	}
+	if rPath.regexp.String() == lPath.regexp.String() {
+		return sameMethods, true
+	}
+	// A static PathPrefix covers every path starting with its prefix.
+	if rPath.matchPrefix && len(rPath.varsN) == 0 && strings.HasPrefix(lPath.prefix, rPath.prefix) {
+		return false, true
+	}
+	return false, false
+}
+
+// hasCustomMatchers returns true if the route has matchers other than its
+// host and path templates.
+func (r *HandlerRouteItem) hasCustomMatchers() bool {
+	for _, m := range r.matchers {
+		if _, ok := m.(*routeRegexp); !ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+)
+
+// Kinds of route items, see RouteInfo.
+const (
+	KindHandler    = "handler"
+	KindContext    = "context"
+	KindController = "controller"
+)
+
+// RouteInfo describes a registered route, see Router.Walk.
+type RouteInfo struct {
+	// Position in the routes, routes are matched in this order.
+	Index int    `json:"index"`
+	Name  string `json:"name,omitempty"`
+	// KindHandler, KindContext or KindController.
+	Kind     string `json:"kind"`
+	Template string `json:"template,omitempty"`
+	Host     string `json:"host,omitempty"`
+	// True for a PathPrefix route.
+	Prefix bool `json:"prefix,omitempty"`
+	// Accepted methods, empty means any method.
+	Methods     []string `json:"methods,omitempty"`
+	OnlyScheme  string   `json:"onlyscheme,omitempty"`
+	SlashOption string   `json:"slash"`
+	CheckAuth   bool     `json:"checkauth,omitempty"`
+	CheckCsrf   bool     `json:"checkcsrf,omitempty"`
+	// Type of the handler, context handlers are listed by method.
+	Handler string `json:"handler,omitempty"`
+	// Error resulted from building the route, the route never matches.
+	Error string `json:"error,omitempty"`
+}
+
+// routeInfoer is implemented by route items which can describe themselves.
+type routeInfoer interface {
+	routeInfo() RouteInfo
+}
+
+// Walk calls fn for every route, in match order. It stops at the first
+// error returned by fn and returns it.
+func (r *Router) Walk(fn func(RouteInfo) error) error {
+	for i, routeitem := range r.loadTable().routes {
+		info := RouteInfo{Kind: fmt.Sprintf("%T", routeitem)}
+		if ri, ok := routeitem.(routeInfoer); ok {
+			info = ri.routeInfo()
+		}
+		info.Index = i
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Routes returns the description of all routes, in match order.
+func (r *Router) Routes() []RouteInfo {
+	infos := []RouteInfo{}
+	r.Walk(func(info RouteInfo) error {
+		infos = append(infos, info)
+		return nil
+	})
+	return infos
+}
+
+// RoutesHandler returns a handler listing the routes, as text or as JSON
+// with "?format=json". It is not registered by default:
+//
+//     r.Handle("/debug/routes", r.RoutesHandler())
+func (r *Router) RoutesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		infos := r.Routes()
+		if req.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+			content, _ := json.MarshalIndent(infos, "", "  ")
+			w.Write(content)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "#\tMETHODS\tHOST\tPATH\tNAME\tKIND\tSCHEME\tSLASH\tHANDLER")
+		for _, info := range infos {
+			methods := "*"
+			if len(info.Methods) > 0 {
+				methods = strings.Join(info.Methods, ",")
+			}
+			path := info.Template
+			if info.Prefix {
+				path += "*"
+			}
+			handler := info.Handler
+			if info.Error != "" {
+				handler = "ERROR: " + info.Error
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", info.Index, methods,
+				orDash(info.Host), orDash(path), orDash(info.Name), info.Kind,
+				orDash(info.OnlyScheme), info.SlashOption, orDash(handler))
+		}
+		tw.Flush()
+	})
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func slashOptionName(option int) string {
+	switch option {
+	case RedictEndSlash:
+		return "redirect"
+	case ExactEndSlash:
+		return "exact"
+	}
+	return "fuzzy"
+}
+
+func (r *HandlerRouteItem) routeInfo() RouteInfo {
+	info := RouteInfo{
+		Name:        r.name,
+		Kind:        KindHandler,
+		Methods:     r.GetMethods(),
+		OnlyScheme:  r.scheme(),
+		SlashOption: slashOptionName(r.endSlashOption),
+		CheckAuth:   r.checkAuth,
+		CheckCsrf:   r.checkCsrf,
+	}
+	if r.regexp != nil {
+		if r.regexp.path != nil {
+			info.Template = r.regexp.path.template
+			info.Prefix = r.regexp.path.matchPrefix
+		}
+		if r.regexp.host != nil {
+			info.Host = r.regexp.host.template
+		}
+	}
+	if r.handler != nil {
+		info.Handler = fmt.Sprintf("%T", r.handler)
+	}
+	if r.err != nil {
+		info.Error = r.err.Error()
+	}
+	return info
+}
+
+func (r *ContextRouteItem) routeInfo() RouteInfo {
+	info := r.HandlerRouteItem.routeInfo()
+	info.Kind = KindContext
+	handlers := []string{}
+	for _, method := range append(append([]string{}, r.methods...), "*") {
+		if name, ok := r.handlerNames[method]; ok {
+			handlers = append(handlers, method+":"+name)
+		}
+	}
+	info.Handler = strings.Join(handlers, " ")
+	return info
+}
+
+func (r *ControllerRouteItem) routeInfo() RouteInfo {
+	info := r.HandlerRouteItem.routeInfo()
+	info.Kind = KindController
+	info.Handler = r.handlerName
+	return info
+}
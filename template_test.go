@@ -56,10 +56,12 @@ func TestTemplate(t *testing.T) {
 	if err := BuildTemplate(dir); err != nil {
 		t.Fatal(err)
 	}
-	if len(BeeTemplates) != 3 {
-		t.Fatalf("should be 3 but got %v", len(BeeTemplates))
+	for _, name := range files {
+		if gRenderer.Template().Lookup(name) == nil {
+			t.Fatalf("template %s not built", name)
+		}
 	}
-	if err := BeeTemplates["index.tpl"].ExecuteTemplate(os.Stdout, "index.tpl", nil); err != nil {
+	if _, err := RenderTemplate("header.tpl", nil); err != nil {
 		t.Fatal(err)
 	}
 	for _, name := range files {